@@ -1,13 +1,20 @@
 package common
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	log "github.com/golang/glog"
+	"github.com/robfig/cron/v3"
 	"gopkg.in/yaml.v2"
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
@@ -32,7 +39,6 @@ type XrayConfig struct {
 	ApiPort           uint16   `json:"apiPort" yaml:"apiPort"`
 	HttpPort          uint16   `json:"httpPort" yaml:"httpPort"`
 	SocksPort         uint16   `json:"socksPort" yaml:"socksPort"`
-	TestPort          uint16   `json:"testPort" yaml:"testPort"`
 	XrayExeDir        string   `json:"xrayExeDir" yaml:"xrayExeDir"`
 	XrayConfigDir     string   `json:"xrayConfigDir" yaml:"xrayConfigDir"`
 	XrayAssetDir      string   `json:"xrayAssetDir" yaml:"xrayAssetDir"`
@@ -40,6 +46,703 @@ type XrayConfig struct {
 	DomainBlacklist   []string `json:"domainBlacklist" yaml:"domainBlacklist"`
 	SubscribeUrl      string   `json:"subscribeUrl" yaml:"subscribeUrl"`
 	SubscribeRetryNum uint16   `json:"subscribeRetryNum" yaml:"subscribeRetryNum"`
+	// Subscriptions 多个订阅，subscribeUrl 不为空时作为名为 default 的订阅加入
+	Subscriptions []SubscriptionConfig `json:"subscriptions" yaml:"subscriptions"`
+	// Fingerprint 节点未指定 fp 时使用的 uTLS 指纹，为空则不设置
+	Fingerprint string        `json:"fingerprint" yaml:"fingerprint"`
+	Freedom     FreedomConfig `json:"freedom" yaml:"freedom"`
+	// Sockopt 全局出站 socket 选项，NodeSockopts 按节点备注(正则)覆盖
+	Sockopt      SockoptConfig       `json:"sockopt" yaml:"sockopt"`
+	NodeSockopts []NodeSockoptConfig `json:"nodeSockopts" yaml:"nodeSockopts"`
+	Test         TestConfig          `json:"test" yaml:"test"`
+	// DataDir 保存测试历史等运行数据的目录，默认为配置文件所在目录下的 data
+	DataDir   string          `json:"dataDir" yaml:"dataDir"`
+	Selection SelectionConfig `json:"selection" yaml:"selection"`
+	// Observatory 开启后由 xray 持续探测 proxy 节点，proxy-balancer 按探测结果选择
+	Observatory ObservatoryConfig `json:"observatory" yaml:"observatory"`
+	// Balancer proxy-balancer 的策略，Balancers 由部分节点组成的其他负载均衡
+	Balancer  BalancerConfig        `json:"balancer" yaml:"balancer"`
+	Balancers []NamedBalancerConfig `json:"balancers" yaml:"balancers"`
+	Watchdog  WatchdogConfig        `json:"watchdog" yaml:"watchdog"`
+	Schedule  ScheduleConfig        `json:"schedule" yaml:"schedule"`
+}
+
+// ScheduleConfig 定时测试，时间单位为秒
+type ScheduleConfig struct {
+	// Interval 测试间隔，每次随机增加 0~Jitter
+	Interval int `json:"interval" yaml:"interval"`
+	Jitter   int `json:"jitter" yaml:"jitter"`
+	// Cron 5 段 cron 表达式，如 "0 */2 * * *"，设置后忽略 Interval
+	Cron string `json:"cron" yaml:"cron"`
+	// QuietHours 不执行定时测试的时间段，如 "01:00-07:00"，可跨零点
+	QuietHours []string `json:"quietHours" yaml:"quietHours"`
+	// RunOnStart 启动时立即测试，默认 true
+	RunOnStart *bool `json:"runOnStart" yaml:"runOnStart"`
+	// RetryInterval 测试出错后的重试间隔，连续出错时加倍，不超过正常调度间隔
+	RetryInterval int `json:"retryInterval" yaml:"retryInterval"`
+}
+
+// WatchdogConfig 定时经由正式入站请求 test.probes，连续失败时立即重新测试，时间单位为秒
+type WatchdogConfig struct {
+	Enabled  bool `json:"enabled" yaml:"enabled"`
+	Interval int  `json:"interval" yaml:"interval"`
+	// Inbounds 探测的入站 http/socks，任一失败即为本次失败
+	Inbounds []string `json:"inbounds" yaml:"inbounds"`
+	// Failures 连续失败多少次后重新测试
+	Failures int `json:"failures" yaml:"failures"`
+	// Cooldown 两次重新测试的最小间隔，重新测试后仍失败时加倍，最大 MaxCooldown
+	Cooldown    int `json:"cooldown" yaml:"cooldown"`
+	MaxCooldown int `json:"maxCooldown" yaml:"maxCooldown"`
+}
+
+// BalancerConfig 负载均衡策略
+type BalancerConfig struct {
+	// Strategy random/roundRobin/leastPing/leastLoad，为空时开启 observatory 则为
+	// leastPing(burst 为 leastLoad)，否则为 random
+	Strategy string `json:"strategy" yaml:"strategy"`
+	// 以下仅用于 leastLoad
+	Expected  int            `json:"expected" yaml:"expected"`
+	MaxRTT    string         `json:"maxRTT" yaml:"maxRTT"`
+	Tolerance float64        `json:"tolerance" yaml:"tolerance"`
+	Baselines []string       `json:"baselines" yaml:"baselines"`
+	Costs     []BalancerCost `json:"costs" yaml:"costs"`
+	// FallbackTag 没有可用节点时使用的出站，如 direct
+	FallbackTag string `json:"fallbackTag" yaml:"fallbackTag"`
+}
+
+// inherit 使用 base 的策略，其余参数只填充未设置的部分，保留自己的 fallbackTag、leastLoad 参数
+func (c *BalancerConfig) inherit(base BalancerConfig) {
+	c.Strategy = base.Strategy
+	if c.Expected == 0 {
+		c.Expected = base.Expected
+	}
+	if c.MaxRTT == "" {
+		c.MaxRTT = base.MaxRTT
+	}
+	if c.Tolerance == 0 {
+		c.Tolerance = base.Tolerance
+	}
+	if len(c.Baselines) == 0 {
+		c.Baselines = base.Baselines
+	}
+	if len(c.Costs) == 0 {
+		c.Costs = base.Costs
+	}
+	if c.FallbackTag == "" {
+		c.FallbackTag = base.FallbackTag
+	}
+}
+
+type BalancerCost struct {
+	Regexp bool    `json:"regexp" yaml:"regexp"`
+	Match  string  `json:"match" yaml:"match"`
+	Value  float32 `json:"value" yaml:"value"`
+}
+
+// NamedBalancerConfig 名为 balancer-<name> 的负载均衡，节点从最近一次测试可用的节点中选取
+type NamedBalancerConfig struct {
+	Name string `json:"name" yaml:"name"`
+	// Nodes 匹配节点备注(正则)或节点 key
+	Nodes []string `json:"nodes" yaml:"nodes"`
+	// Site 只选择站点检查 test.sites 中该站点通过的节点，没有节点通过时负载均衡为空，
+	// 经由 fallbackTag(默认 direct)访问
+	Site string `json:"site" yaml:"site"`
+	// TopN 按评分最多选择的节点数，默认与 selection.topN 相同
+	TopN int `json:"topN" yaml:"topN"`
+	// Domains 经由该负载均衡的域名，格式与路由规则相同，如 geosite:netflix、domain:example.com
+	Domains []string `json:"domains" yaml:"domains"`
+	// Strategy 为空时使用 proxy-balancer 的策略，未设置的其他参数也与 proxy-balancer 相同
+	BalancerConfig `json:",inline" yaml:",inline"`
+}
+
+// ObservatoryConfig xray observatory/burstObservatory 设置
+type ObservatoryConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Burst 使用 burstObservatory 并以 leastLoad 均衡，否则使用 observatory 并以 leastPing 均衡
+	Burst         bool   `json:"burst" yaml:"burst"`
+	ProbeUrl      string `json:"probeUrl" yaml:"probeUrl"`
+	ProbeInterval string `json:"probeInterval" yaml:"probeInterval"`
+	// 以下仅用于 burstObservatory
+	Sampling     int    `json:"sampling" yaml:"sampling"`
+	Timeout      string `json:"timeout" yaml:"timeout"`
+	Connectivity string `json:"connectivity" yaml:"connectivity"`
+}
+
+type SubscriptionConfig struct {
+	Name string `json:"name" yaml:"name"`
+	Url  string `json:"url" yaml:"url"`
+}
+
+// SelectionConfig 写入 proxy-balancer 的节点选择策略
+type SelectionConfig struct {
+	// TopN 最多选择的节点数
+	TopN int `json:"topN" yaml:"topN"`
+	// MaxLatency 大于 0 时中位延迟(毫秒)超过该值的节点不选
+	MaxLatency int `json:"maxLatency" yaml:"maxLatency"`
+	// MinPoolSize 符合条件的节点不足时，用其余可用节点按评分补足
+	MinPoolSize int `json:"minPoolSize" yaml:"minPoolSize"`
+	// SubscriptionQuota 每个订阅最多选择的节点数
+	SubscriptionQuota map[string]int `json:"subscriptionQuota" yaml:"subscriptionQuota"`
+	// Regions 按备注(正则)划分地区，RegionQuota 每个地区最多选择的节点数
+	Regions     []RegionConfig `json:"regions" yaml:"regions"`
+	RegionQuota map[string]int `json:"regionQuota" yaml:"regionQuota"`
+	// AlwaysInclude 测试可用时总是选择，NeverInclude 总是不选；
+	// 匹配节点备注(正则)或节点 key
+	AlwaysInclude []string `json:"alwaysInclude" yaml:"alwaysInclude"`
+	NeverInclude  []string `json:"neverInclude" yaml:"neverInclude"`
+	// Margin 当前已选节点本轮仍可用时，其他节点的评分须优于它该比例才替换它，避免频繁切换；
+	// 默认 0.1，小于 0 时不保留当前节点
+	Margin float64 `json:"margin" yaml:"margin"`
+}
+
+type RegionConfig struct {
+	Name    string `json:"name" yaml:"name"`
+	Pattern string `json:"pattern" yaml:"pattern"`
+}
+
+func (c *WatchdogConfig) Check() error {
+	if c.Interval <= 0 {
+		c.Interval = 30
+	}
+	if len(c.Inbounds) == 0 {
+		c.Inbounds = []string{"http", "socks"}
+	}
+	for _, in := range c.Inbounds {
+		if in != "http" && in != "socks" {
+			return fmt.Errorf("watchdog: unknown inbound '%v'", in)
+		}
+	}
+	if c.Failures <= 0 {
+		c.Failures = 3
+	}
+	if c.Cooldown <= 0 {
+		c.Cooldown = 300
+	}
+	if c.MaxCooldown < c.Cooldown {
+		c.MaxCooldown = 3600
+		if c.MaxCooldown < c.Cooldown {
+			c.MaxCooldown = c.Cooldown
+		}
+	}
+	return nil
+}
+
+func (c *ScheduleConfig) Check() error {
+	if c.Interval <= 0 {
+		c.Interval = 7200
+	}
+	if c.Jitter < 0 {
+		c.Jitter = 0
+	}
+	if c.Cron != "" {
+		if _, err := cron.ParseStandard(c.Cron); err != nil {
+			return fmt.Errorf("schedule: invalid cron '%v': %v", c.Cron, err)
+		}
+	}
+	for _, q := range c.QuietHours {
+		if _, _, err := ParseQuietHours(q); err != nil {
+			return fmt.Errorf("schedule: %v", err)
+		}
+	}
+	if c.RunOnStart == nil {
+		runOnStart := true
+		c.RunOnStart = &runOnStart
+	}
+	if c.RetryInterval <= 0 {
+		c.RetryInterval = 60
+	}
+	return nil
+}
+
+// ParseQuietHours 解析 "HH:MM-HH:MM"，返回起止时间距零点的分钟数
+func ParseQuietHours(s string) (int, int, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid quiet hours '%v'", s)
+	}
+	var minutes [2]int
+	for i, p := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(p))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid quiet hours '%v': %v", s, err)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	return minutes[0], minutes[1], nil
+}
+
+var balancerNamePattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// fingerprints xray 支持的 uTLS 指纹名称，区分大小写
+var fingerprints = []string{"chrome", "firefox", "safari", "ios", "android", "edge", "360", "qq",
+	"random", "randomized", "randomizednoalpn"}
+
+// CheckFingerprint 指纹为空或为 xray 支持的名称，未知名称会导致 xray 无法加载配置
+func CheckFingerprint(fp string) error {
+	if fp == "" || slices.Contains(fingerprints, fp) {
+		return nil
+	}
+	return fmt.Errorf("unknown fingerprint '%v', expected one of %v", fp, strings.Join(fingerprints, ", "))
+}
+
+// Check 校验策略，observatory 为 Check 过的配置
+func (c *BalancerConfig) Check(observatory ObservatoryConfig) error {
+	switch strings.ToLower(c.Strategy) {
+	case "":
+		c.Strategy = "random"
+		if observatory.Enabled {
+			c.Strategy = "leastPing"
+			if observatory.Burst {
+				c.Strategy = "leastLoad"
+			}
+		}
+	case "random", "roundrobin":
+	case "leastping", "leastload":
+		if !observatory.Enabled {
+			return fmt.Errorf("balancer: strategy %v requires observatory", c.Strategy)
+		}
+	default:
+		return fmt.Errorf("balancer: unknown strategy '%v'", c.Strategy)
+	}
+	for _, d := range append([]string{c.MaxRTT}, c.Baselines...) {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return fmt.Errorf("balancer: invalid duration '%v': %v", d, err)
+		}
+	}
+	for _, cost := range c.Costs {
+		if !cost.Regexp {
+			continue
+		}
+		if _, err := regexp.Compile(cost.Match); err != nil {
+			return fmt.Errorf("balancer: invalid cost pattern '%v': %v", cost.Match, err)
+		}
+	}
+	return nil
+}
+
+func (c *ObservatoryConfig) Check() error {
+	if strings.TrimSpace(c.ProbeUrl) == "" {
+		c.ProbeUrl = "https://www.gstatic.com/generate_204"
+	}
+	if c.ProbeInterval == "" {
+		c.ProbeInterval = "1m"
+	}
+	if c.Sampling <= 0 {
+		c.Sampling = 10
+	}
+	if c.Timeout == "" {
+		c.Timeout = "5s"
+	}
+	for _, d := range []string{c.ProbeInterval, c.Timeout} {
+		if _, err := time.ParseDuration(d); err != nil {
+			return fmt.Errorf("observatory: invalid duration '%v': %v", d, err)
+		}
+	}
+	return nil
+}
+
+func (c *SelectionConfig) Check() error {
+	if c.TopN <= 0 {
+		c.TopN = 5
+	}
+	if c.MinPoolSize <= 0 {
+		c.MinPoolSize = 1
+	}
+	if c.MinPoolSize > c.TopN {
+		c.MinPoolSize = c.TopN
+	}
+	if c.Margin == 0 {
+		c.Margin = 0.1
+	}
+	if c.Margin < 0 {
+		c.Margin = 0
+	}
+	if c.Margin >= 1 {
+		return fmt.Errorf("selection.margin must be less than 1")
+	}
+	for _, r := range c.Regions {
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("selection.regions: invalid pattern '%v': %v", r.Pattern, err)
+		}
+	}
+	for _, p := range append(append([]string{}, c.AlwaysInclude...), c.NeverInclude...) {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("selection: invalid node pattern '%v': %v", p, err)
+		}
+	}
+	return nil
+}
+
+// TestConfig 节点测试设置
+type TestConfig struct {
+	Probes []ProbeConfig `json:"probes" yaml:"probes"`
+	// Concurrency 同时测试的节点数
+	Concurrency int `json:"concurrency" yaml:"concurrency"`
+	// ProbeTimeout 单次请求超时(秒)
+	ProbeTimeout int `json:"probeTimeout" yaml:"probeTimeout"`
+	// Deadline 一轮测试的总时限(秒)，超时后只使用已完成的结果；带宽测试使用 throughput.deadline
+	Deadline int `json:"deadline" yaml:"deadline"`
+	// Samples 每个节点的采样次数
+	Samples    int              `json:"samples" yaml:"samples"`
+	Score      ScoreConfig      `json:"score" yaml:"score"`
+	Throughput ThroughputConfig `json:"throughput" yaml:"throughput"`
+	Udp        UdpTestConfig    `json:"udp" yaml:"udp"`
+	History    HistoryConfig    `json:"history" yaml:"history"`
+	Exit       ExitTestConfig   `json:"exit" yaml:"exit"`
+	// Sites 对可用节点逐个检查的站点
+	Sites []SiteConfig `json:"sites" yaml:"sites"`
+	// Prescreen 测试前直接连接节点服务器，不通过的节点不再测试
+	Prescreen PrescreenConfig `json:"prescreen" yaml:"prescreen"`
+	// Quarantine 连续失败的节点暂停测试
+	Quarantine QuarantineConfig `json:"quarantine" yaml:"quarantine"`
+}
+
+// QuarantineConfig 连续 Failures 轮测试失败的节点隔离 Duration 秒，每次再隔离时间加倍，最长 MaxDuration 秒；
+// 隔离结束后试测一轮，失败则立即再次隔离
+type QuarantineConfig struct {
+	Enabled     bool `json:"enabled" yaml:"enabled"`
+	Failures    int  `json:"failures" yaml:"failures"`
+	Duration    int  `json:"duration" yaml:"duration"`
+	MaxDuration int  `json:"maxDuration" yaml:"maxDuration"`
+}
+
+func (c *QuarantineConfig) Check() error {
+	if c.Failures <= 0 {
+		c.Failures = 3
+	}
+	if c.Duration <= 0 {
+		c.Duration = 1800
+	}
+	if c.MaxDuration < c.Duration {
+		c.MaxDuration = 86400
+		if c.MaxDuration < c.Duration {
+			c.MaxDuration = c.Duration
+		}
+	}
+	return nil
+}
+
+// PrescreenConfig 直接解析、连接节点服务器，TLS 节点完成握手并检查证书
+type PrescreenConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Concurrency 同时检查的节点数，Timeout 单个节点的超时(秒)
+	Concurrency int `json:"concurrency" yaml:"concurrency"`
+	Timeout     int `json:"timeout" yaml:"timeout"`
+}
+
+func (c *PrescreenConfig) Check() error {
+	if c.Concurrency <= 0 {
+		c.Concurrency = 64
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 3
+	}
+	return nil
+}
+
+// SiteConfig 站点检查，请求一次 Url 并按 expectStatus/bodyContains/bodyNotContains 判断是否可用
+type SiteConfig struct {
+	Name        string `json:"name" yaml:"name"`
+	ProbeConfig `json:",inline" yaml:",inline"`
+}
+
+// HistoryConfig 测试历史，Alpha 为指数加权平均中本轮结果的权重，
+// 成功率低于 MinSuccessRate 的节点不会被选中
+type HistoryConfig struct {
+	Alpha          float64 `json:"alpha" yaml:"alpha"`
+	MaxRecords     int     `json:"maxRecords" yaml:"maxRecords"`
+	MinSuccessRate float64 `json:"minSuccessRate" yaml:"minSuccessRate"`
+}
+
+func (c *HistoryConfig) Check() error {
+	if c.Alpha <= 0 || c.Alpha > 1 {
+		c.Alpha = 0.3
+	}
+	if c.MaxRecords <= 0 {
+		c.MaxRecords = 50
+	}
+	if c.MinSuccessRate <= 0 {
+		c.MinSuccessRate = 0.5
+	}
+	return nil
+}
+
+// ExitTestConfig 经由可用节点查询出口 IP 及所在地
+type ExitTestConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Url 返回出口 IP 的地址，响应为纯文本 IP 或含 ip/country/asn 等字段的 json；
+	// 响应中没有国家时使用 xrayAssetDir 下的 geoip.dat 查询
+	Url string `json:"url" yaml:"url"`
+	// Timeout 单次查询超时(秒)
+	Timeout int `json:"timeout" yaml:"timeout"`
+}
+
+func (c *ExitTestConfig) Check() error {
+	if strings.TrimSpace(c.Url) == "" {
+		c.Url = "https://ipinfo.io/json"
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 5
+	}
+	return nil
+}
+
+// UdpTestConfig UDP 测试，经节点测试入站的 UDP ASSOCIATE 向 DnsServer 查询 Domain
+type UdpTestConfig struct {
+	Enabled   bool   `json:"enabled" yaml:"enabled"`
+	DnsServer string `json:"dnsServer" yaml:"dnsServer"`
+	Domain    string `json:"domain" yaml:"domain"`
+	// Timeout 单次查询超时(秒)
+	Timeout int `json:"timeout" yaml:"timeout"`
+	// Require 只选择支持 UDP 的节点
+	Require bool `json:"require" yaml:"require"`
+	// Route 非中国大陆的 UDP 流量走只包含支持 UDP 节点的 proxy-udp-balancer
+	Route bool `json:"route" yaml:"route"`
+}
+
+func (c *UdpTestConfig) Check() error {
+	if strings.TrimSpace(c.DnsServer) == "" {
+		c.DnsServer = "8.8.8.8:53"
+	}
+	if strings.TrimSpace(c.Domain) == "" {
+		c.Domain = "www.google.com"
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 3
+	}
+	if c.Route && !c.Enabled {
+		return errors.New("test.udp.route requires test.udp.enabled, otherwise proxy-udp-balancer has no node")
+	}
+	return nil
+}
+
+// ThroughputConfig 带宽测试，只对延迟排名靠前的 Candidates 个节点下载 Url 的前 Bytes 字节
+type ThroughputConfig struct {
+	Enabled    bool   `json:"enabled" yaml:"enabled"`
+	Url        string `json:"url" yaml:"url"`
+	Bytes      int64  `json:"bytes" yaml:"bytes"`
+	Candidates int    `json:"candidates" yaml:"candidates"`
+	// Concurrency 同时下载的节点数，默认 1，避免互相抢占带宽
+	Concurrency int `json:"concurrency" yaml:"concurrency"`
+	// Timeout 单个节点下载超时(秒)
+	Timeout int `json:"timeout" yaml:"timeout"`
+	// Deadline 带宽测试的总时限(秒)，不受 test.deadline 限制，默认按 candidates、concurrency 与 timeout 计算
+	Deadline int `json:"deadline" yaml:"deadline"`
+	// MinMbps 大于 0 时低于该带宽的节点不会被选中
+	MinMbps float64 `json:"minMbps" yaml:"minMbps"`
+}
+
+func (c *ThroughputConfig) Check() error {
+	if strings.TrimSpace(c.Url) == "" {
+		c.Url = "http://cachefly.cachefly.net/10mb.test"
+	}
+	if c.Bytes <= 0 {
+		c.Bytes = 5 << 20
+	}
+	if c.Candidates <= 0 {
+		c.Candidates = 10
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 1
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 20
+	}
+	if c.Deadline <= 0 {
+		c.Deadline = (c.Candidates + c.Concurrency - 1) / c.Concurrency * c.Timeout
+	}
+	return nil
+}
+
+// ScoreConfig 节点评分权重，score = median*Median + p90*P90 + jitter*Jitter + loss*Loss，越小越好；
+// 延迟单位为毫秒，loss 为 0~1 的丢失率
+type ScoreConfig struct {
+	Median float64 `json:"median" yaml:"median"`
+	P90    float64 `json:"p90" yaml:"p90"`
+	Jitter float64 `json:"jitter" yaml:"jitter"`
+	Loss   float64 `json:"loss" yaml:"loss"`
+}
+
+// ProbeConfig 测试目标，ExpectStatus 为空时 2xx/3xx 视为成功
+type ProbeConfig struct {
+	Url          string `json:"url" yaml:"url"`
+	Method       string `json:"method" yaml:"method"`
+	ExpectStatus []int  `json:"expectStatus" yaml:"expectStatus"`
+	BodyContains string `json:"bodyContains" yaml:"bodyContains"`
+	// BodyNotContains 响应体包含该内容时视为失败，如地区限制提示
+	BodyNotContains string `json:"bodyNotContains" yaml:"bodyNotContains"`
+	Weight          int    `json:"weight" yaml:"weight"`
+}
+
+func (c *TestConfig) HasSite(name string) bool {
+	for _, site := range c.Sites {
+		if site.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ProbeConfig) Check() error {
+	if strings.TrimSpace(c.Url) == "" {
+		return errors.New("url is empty")
+	}
+	if c.Method == "" {
+		c.Method = "GET"
+	}
+	c.Method = strings.ToUpper(c.Method)
+	if c.Weight <= 0 {
+		c.Weight = 1
+	}
+	return nil
+}
+
+func (c *TestConfig) Check() error {
+	if len(c.Probes) == 0 {
+		c.Probes = []ProbeConfig{
+			{Url: "http://www.gstatic.com/generate_204", ExpectStatus: []int{204}},
+			{Url: "http://cp.cloudflare.com/generate_204", ExpectStatus: []int{204}},
+		}
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 16
+	}
+	if c.ProbeTimeout <= 0 {
+		c.ProbeTimeout = 5
+	}
+	if c.Deadline <= 0 {
+		c.Deadline = 60
+	}
+	if c.Samples <= 0 {
+		c.Samples = 3
+	}
+	if c.Score == (ScoreConfig{}) {
+		c.Score = ScoreConfig{Median: 1, P90: 0.5, Jitter: 0.5, Loss: 2000}
+	}
+	err := c.Throughput.Check()
+	if err != nil {
+		return err
+	}
+	err = c.Udp.Check()
+	if err != nil {
+		return err
+	}
+	err = c.History.Check()
+	if err != nil {
+		return err
+	}
+	err = c.Exit.Check()
+	if err != nil {
+		return err
+	}
+	err = c.Prescreen.Check()
+	if err != nil {
+		return err
+	}
+	err = c.Quarantine.Check()
+	if err != nil {
+		return err
+	}
+	for i := range c.Probes {
+		if err := c.Probes[i].Check(); err != nil {
+			return fmt.Errorf("test.probes[%d]: %v", i, err)
+		}
+	}
+	names := make(map[string]bool)
+	for i := range c.Sites {
+		site := &c.Sites[i]
+		if !balancerNamePattern.MatchString(site.Name) {
+			return fmt.Errorf("test.sites[%d]: name '%v' may only contain letters, digits and '-'", i, site.Name)
+		}
+		if names[site.Name] {
+			return fmt.Errorf("test.sites: duplicate name '%v'", site.Name)
+		}
+		names[site.Name] = true
+		if err := site.ProbeConfig.Check(); err != nil {
+			return fmt.Errorf("test.sites[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+type SockoptConfig struct {
+	Mark                 int    `json:"mark" yaml:"mark"`
+	Interface            string `json:"interface" yaml:"interface"`
+	TCPFastOpen          bool   `json:"tcpFastOpen" yaml:"tcpFastOpen"`
+	DomainStrategy       string `json:"domainStrategy" yaml:"domainStrategy"`
+	TCPKeepAliveInterval int    `json:"tcpKeepAliveInterval" yaml:"tcpKeepAliveInterval"`
+}
+
+// Merge 用 o 中非零值覆盖当前设置
+func (c SockoptConfig) Merge(o SockoptConfig) SockoptConfig {
+	if o.Mark != 0 {
+		c.Mark = o.Mark
+	}
+	if o.Interface != "" {
+		c.Interface = o.Interface
+	}
+	if o.TCPFastOpen {
+		c.TCPFastOpen = true
+	}
+	if o.DomainStrategy != "" {
+		c.DomainStrategy = o.DomainStrategy
+	}
+	if o.TCPKeepAliveInterval != 0 {
+		c.TCPKeepAliveInterval = o.TCPKeepAliveInterval
+	}
+	return c
+}
+
+func (c SockoptConfig) IsZero() bool {
+	return c == SockoptConfig{}
+}
+
+type NodeSockoptConfig struct {
+	Node    string        `json:"node" yaml:"node"`
+	Sockopt SockoptConfig `json:"sockopt" yaml:"sockopt"`
+}
+
+// FreedomConfig direct 出站(freedom)的分片与噪声设置
+type FreedomConfig struct {
+	Fragment FragmentConfig `json:"fragment" yaml:"fragment"`
+	Noise    NoiseConfig    `json:"noise" yaml:"noise"`
+}
+
+type FragmentConfig struct {
+	Enabled  bool   `json:"enabled" yaml:"enabled"`
+	Packets  string `json:"packets" yaml:"packets"`
+	Length   string `json:"length" yaml:"length"`
+	Interval string `json:"interval" yaml:"interval"`
+}
+
+type NoiseConfig struct {
+	Enabled bool        `json:"enabled" yaml:"enabled"`
+	Noises  []NoiseItem `json:"noises" yaml:"noises"`
+}
+
+type NoiseItem struct {
+	Type   string `json:"type" yaml:"type"`
+	Packet string `json:"packet" yaml:"packet"`
+	Delay  string `json:"delay" yaml:"delay"`
+}
+
+func (c *FreedomConfig) Check() error {
+	if strings.TrimSpace(c.Fragment.Packets) == "" {
+		c.Fragment.Packets = "tlshello"
+	}
+	if strings.TrimSpace(c.Fragment.Length) == "" {
+		c.Fragment.Length = "100-200"
+	}
+	if strings.TrimSpace(c.Fragment.Interval) == "" {
+		c.Fragment.Interval = "10-20"
+	}
+	if len(c.Noise.Noises) == 0 {
+		c.Noise.Noises = []NoiseItem{{Type: "rand", Packet: "10-20", Delay: "10-16"}}
+	}
+	return nil
 }
 
 func (c *XrayConfig) Check() error {
@@ -51,6 +754,22 @@ func (c *XrayConfig) Check() error {
 		c.SubscribeRetryNum = 3
 	}
 
+	if strings.TrimSpace(c.SubscribeUrl) != "" {
+		c.Subscriptions = append([]SubscriptionConfig{{Name: "default", Url: c.SubscribeUrl}}, c.Subscriptions...)
+	}
+	for i, sub := range c.Subscriptions {
+		if strings.TrimSpace(sub.Url) == "" {
+			return fmt.Errorf("subscriptions[%d]: url is empty", i)
+		}
+		if sub.Name == "" {
+			c.Subscriptions[i].Name = "subscription" + strconv.Itoa(i)
+		}
+	}
+
+	if err := CheckFingerprint(c.Fingerprint); err != nil {
+		return err
+	}
+
 	if strings.TrimSpace(c.XrayConfigDir) == "" {
 		c.XrayConfigDir = "."
 	}
@@ -75,8 +794,80 @@ func (c *XrayConfig) Check() error {
 		c.SocksPort = 10902
 	}
 
-	if c.TestPort == 0 {
-		c.TestPort = 10903
+	err := c.Freedom.Check()
+	if err != nil {
+		return err
+	}
+
+	err = c.Test.Check()
+	if err != nil {
+		return err
+	}
+
+	err = c.Selection.Check()
+	if err != nil {
+		return err
+	}
+
+	err = c.Observatory.Check()
+	if err != nil {
+		return err
+	}
+
+	err = c.Schedule.Check()
+	if err != nil {
+		return err
+	}
+
+	err = c.Watchdog.Check()
+	if err != nil {
+		return err
+	}
+
+	err = c.Balancer.Check(c.Observatory)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for i := range c.Balancers {
+		b := &c.Balancers[i]
+		if !balancerNamePattern.MatchString(b.Name) {
+			return fmt.Errorf("balancers[%d]: name '%v' may only contain letters, digits and '-'", i, b.Name)
+		}
+		if names[b.Name] {
+			return fmt.Errorf("balancers: duplicate name '%v'", b.Name)
+		}
+		names[b.Name] = true
+		for _, p := range b.Nodes {
+			if _, err := regexp.Compile(p); err != nil {
+				return fmt.Errorf("balancers[%d]: invalid node pattern '%v': %v", i, p, err)
+			}
+		}
+		if len(b.Nodes) == 0 && b.Site == "" {
+			return fmt.Errorf("balancers[%d]: nodes or site is required", i)
+		}
+		if b.Site != "" && !c.Test.HasSite(b.Site) {
+			return fmt.Errorf("balancers[%d]: unknown site '%v'", i, b.Site)
+		}
+		if b.TopN <= 0 {
+			b.TopN = c.Selection.TopN
+		}
+		if b.Strategy == "" {
+			b.inherit(c.Balancer)
+		}
+		if b.Site != "" && b.FallbackTag == "" {
+			b.FallbackTag = "direct"
+		}
+		err = b.BalancerConfig.Check(c.Observatory)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, n := range c.NodeSockopts {
+		if _, err := regexp.Compile(n.Node); err != nil {
+			return fmt.Errorf("nodeSockopts: invalid node pattern '%v': %v", n.Node, err)
+		}
 	}
 
 	return nil
@@ -123,6 +914,9 @@ func ReadConfig() (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if strings.TrimSpace(config.XrayConfig.DataDir) == "" {
+		config.XrayConfig.DataDir = filepath.Join(dir, "data")
+	}
 	err = config.Check()
 	if err != nil {
 		return nil, err
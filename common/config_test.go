@@ -0,0 +1,78 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBalancerConfigInherit(t *testing.T) {
+	base := BalancerConfig{Strategy: "leastLoad", Expected: 2, MaxRTT: "1s", Baselines: []string{"1s"}, FallbackTag: "direct"}
+	tests := []struct {
+		name string
+		own  BalancerConfig
+		want BalancerConfig
+	}{
+		{"empty", BalancerConfig{}, base},
+		{
+			"own fallback kept",
+			BalancerConfig{FallbackTag: "blocked"},
+			BalancerConfig{Strategy: "leastLoad", Expected: 2, MaxRTT: "1s", Baselines: []string{"1s"}, FallbackTag: "blocked"},
+		},
+		{
+			"own leastLoad settings kept",
+			BalancerConfig{Expected: 5, Tolerance: 0.1},
+			BalancerConfig{Strategy: "leastLoad", Expected: 5, MaxRTT: "1s", Tolerance: 0.1, Baselines: []string{"1s"}, FallbackTag: "direct"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.own
+			got.inherit(base)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("inherit() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQuietHours(t *testing.T) {
+	tests := []struct {
+		s          string
+		start, end int
+		wantErr    bool
+	}{
+		{"02:00-06:00", 120, 360, false},
+		{"23:30 - 07:15", 1410, 435, false},
+		{"02:00", 0, 0, true},
+		{"25:00-06:00", 0, 0, true},
+	}
+	for _, tt := range tests {
+		start, end, err := ParseQuietHours(tt.s)
+		if (err != nil) != tt.wantErr || start != tt.start || end != tt.end {
+			t.Errorf("ParseQuietHours(%q) = %v, %v, %v", tt.s, start, end, err)
+		}
+	}
+}
+
+func TestThroughputConfigDeadline(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ThroughputConfig
+		want   int
+	}{
+		{"defaults", ThroughputConfig{}, 200},
+		{"concurrent", ThroughputConfig{Candidates: 10, Concurrency: 3, Timeout: 10}, 40},
+		{"explicit", ThroughputConfig{Deadline: 30}, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.config
+			if err := c.Check(); err != nil {
+				t.Fatal(err)
+			}
+			if c.Deadline != tt.want {
+				t.Errorf("Deadline = %v, want %v", c.Deadline, tt.want)
+			}
+		})
+	}
+}
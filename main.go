@@ -42,6 +42,7 @@ func start() error {
 			c <- e
 		}
 		xrayApp.TimeTest()
+		xrayApp.Watchdog()
 	}(errors)
 
 	go func(c chan<- error) {
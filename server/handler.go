@@ -1,7 +1,13 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
+	log "github.com/golang/glog"
 	"net/http"
+	"strconv"
+	"strings"
+	"xray-helper/common"
 	"xray-helper/xray"
 )
 
@@ -20,8 +26,10 @@ func Refresh(w http.ResponseWriter, r *http.Request) {
 	} else {
 		w.Write([]byte("xray refresh"))
 		go func() {
-			app.TestAll()
-			app.Restart(false)
+			err := app.TestAll()
+			if err != nil {
+				log.Errorf("refresh test failed %v", err)
+			}
 		}()
 	}
 
@@ -41,6 +49,380 @@ func ReStart(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// TestProgress 查看当前测试进度
+func TestProgress(w http.ResponseWriter, r *http.Request) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	writeJson(w, app.TestProgress())
+}
+
+// History 查看节点测试历史
+func History(w http.ResponseWriter, r *http.Request) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	history, err := app.History()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, history.All())
+}
+
+// Quarantine 查看隔离中及试测中的节点
+func Quarantine(w http.ResponseWriter, r *http.Request) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	history, err := app.History()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, history.Quarantined())
+}
+
+// Prescreen 查看最近一次直接连接检查的结果
+func Prescreen(w http.ResponseWriter, r *http.Request) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	writeJson(w, app.PrescreenReport())
+}
+
+// Sites 查看最近一次站点检查中各节点的结果
+func Sites(w http.ResponseWriter, r *http.Request) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	writeJson(w, app.SiteMatrix())
+}
+
+// Diagnose 经由指定节点(key、tag 或备注)请求一次 url，返回各阶段耗时，
+// 例: /diagnose?node=xxx&url=https://www.google.com
+func Diagnose(w http.ResponseWriter, r *http.Request) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	q := r.URL.Query()
+	v, err := app.FindNode(q.Get("node"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	url := q.Get("url")
+	if url == "" {
+		url = app.ProbeUrl()
+	}
+	writeJson(w, app.Diagnose(r.Context(), v, url))
+}
+
+// Nodes 查看订阅中的节点及其标签、备注，带 label 参数时只返回带有该标签的节点
+func Nodes(w http.ResponseWriter, r *http.Request) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	nodes, err := app.Nodes(r.URL.Query().Get("label"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, nodes)
+}
+
+// NodeMeta 为节点(key、tag 或备注)增删标签、修改备注，
+// 例: /nodes/meta?node=xxx&add=a,b&remove=c&note=text
+func NodeMeta(w http.ResponseWriter, r *http.Request) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	q := r.URL.Query()
+	v, err := app.FindNode(q.Get("node"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var note *string
+	if q.Has("note") {
+		n := q.Get("note")
+		note = &n
+	}
+	meta, err := app.UpdateNodeMeta(v, splitList(q.Get("add")), splitList(q.Get("remove")), note)
+	if err != nil {
+		log.Errorf("update node meta failed %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, meta)
+}
+
+// Pin 查看固定设置，带 node 或 label 参数时固定 proxy-balancer 只使用该节点或带有该标签的节点，
+// 两者都为空时取消固定，例: /nodes/pin?label=game
+func Pin(w http.ResponseWriter, r *http.Request) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	q := r.URL.Query()
+	if !q.Has("node") && !q.Has("label") {
+		pin, err := app.PinStatus()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJson(w, pin)
+		return
+	}
+	pin, err := app.PinNodes(q.Get("node"), q.Get("label"))
+	if errors.Is(err, xray.ErrNodeNotFound) || errors.Is(err, xray.ErrNoNodeToPin) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf("pin nodes failed %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, pin)
+}
+
+// Selection 查看节点选择策略及最近一次选择结果
+func Selection(w http.ResponseWriter, r *http.Request) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	writeJson(w, app.SelectionReport())
+}
+
+// CancelTest 取消正在进行的测试
+func CancelTest(w http.ResponseWriter, r *http.Request) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	if app.CancelTest() {
+		w.Write([]byte("test cancelled"))
+	} else {
+		w.Write([]byte("no test running"))
+	}
+}
+
+// AntiCensorship 查看或修改 direct 出站分片/噪声及默认 uTLS 指纹
+// 例: /anticensorship?fragment=on&noise=off&fingerprint=chrome
+func AntiCensorship(w http.ResponseWriter, r *http.Request) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	q := r.URL.Query()
+	ac := app.GetAntiCensorship()
+	changed := false
+	if q.Has("fragment") {
+		ac.Fragment = isOn(q.Get("fragment"))
+		changed = true
+	}
+	if q.Has("noise") {
+		ac.Noise = isOn(q.Get("noise"))
+		changed = true
+	}
+	if q.Has("fingerprint") {
+		ac.Fingerprint = q.Get("fingerprint")
+		if err := common.CheckFingerprint(ac.Fingerprint); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		changed = true
+	}
+	if changed {
+		err := app.SetAntiCensorship(ac)
+		if err != nil {
+			log.Errorf("set anti censorship failed %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJson(w, app.GetAntiCensorship())
+}
+
+// Whitelist 查看或修改直连域名，例: /routing/whitelist?add=a.com,b.com&remove=c.com
+func Whitelist(w http.ResponseWriter, r *http.Request) {
+	domainList(w, r, true)
+}
+
+// Blacklist 查看或修改代理域名，参数同 Whitelist
+func Blacklist(w http.ResponseWriter, r *http.Request) {
+	domainList(w, r, false)
+}
+
+func domainList(w http.ResponseWriter, r *http.Request, whitelist bool) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	q := r.URL.Query()
+	add := splitList(q.Get("add"))
+	remove := splitList(q.Get("remove"))
+	if len(add) == 0 && len(remove) == 0 {
+		writeJson(w, app.DomainList(whitelist))
+		return
+	}
+	list, err := app.UpdateDomainList(r.Context(), whitelist, add, remove)
+	if errors.Is(err, xray.ErrInvalidRouting) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Errorf("update domain list failed %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, list)
+}
+
+// TestRoute 查询路由结果，例: /routing/test?target=www.google.com&port=443&network=tcp&inbound=inbounds-http
+func TestRoute(w http.ResponseWriter, r *http.Request) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	q := r.URL.Query()
+	target := q.Get("target")
+	if target == "" {
+		http.Error(w, "target is required", http.StatusBadRequest)
+		return
+	}
+	port, _ := strconv.ParseUint(q.Get("port"), 10, 16)
+	if port == 0 {
+		port = 443
+	}
+	inbound := q.Get("inbound")
+	if inbound == "" {
+		inbound = "inbounds-http"
+	}
+	result, err := app.TestRoute(r.Context(), inbound, q.Get("network"), target, uint32(port))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, result)
+}
+
+// Balancer 查看负载均衡状态，带 target 参数时固定出站(target 为空取消)，
+// 例: /routing/balancer?tag=proxy-balancer&target=proxy_-xxx
+func Balancer(w http.ResponseWriter, r *http.Request) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	q := r.URL.Query()
+	tag := q.Get("tag")
+	if tag == "" {
+		tag = "proxy-balancer"
+	}
+	if q.Has("target") {
+		err := app.OverrideBalancer(r.Context(), tag, q.Get("target"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	info, err := app.BalancerInfo(r.Context(), tag)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, info)
+}
+
+// Observatory 查看 observatory 对各 proxy 出站的探测状态
+func Observatory(w http.ResponseWriter, r *http.Request) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	status, err := app.ObservatoryStatus(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, status)
+}
+
+// Watchdog 查看 watchdog 状态
+func Watchdog(w http.ResponseWriter, r *http.Request) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	writeJson(w, app.WatchdogStatus())
+}
+
+// Schedule 查看下次定时测试时间及最近一次测试结果
+func Schedule(w http.ResponseWriter, r *http.Request) {
+	app := xray.CurrentXrayApp
+	if app == nil {
+		w.Write([]byte("xray not started"))
+		return
+	}
+	writeJson(w, app.ScheduleStatus())
+}
+
 func Root(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("xray helper"))
 }
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func isOn(s string) bool {
+	switch s {
+	case "on", "true", "1", "yes":
+		return true
+	}
+	return false
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
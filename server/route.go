@@ -3,9 +3,28 @@ package server
 import "net/http"
 
 var routeMap = map[string]http.HandlerFunc{
-	"/addoutbound":    AddOutbound,
-	"/removeoutbound": RemoveOutbound,
-	"/refresh":        Refresh,
-	"/restart":        ReStart,
-	"/":               Root,
+	"/addoutbound":       AddOutbound,
+	"/removeoutbound":    RemoveOutbound,
+	"/refresh":           Refresh,
+	"/restart":           ReStart,
+	"/anticensorship":    AntiCensorship,
+	"/test/progress":     TestProgress,
+	"/test/cancel":       CancelTest,
+	"/test/history":      History,
+	"/test/sites":        Sites,
+	"/test/prescreen":    Prescreen,
+	"/test/quarantine":   Quarantine,
+	"/selection":         Selection,
+	"/nodes":             Nodes,
+	"/nodes/meta":        NodeMeta,
+	"/nodes/pin":         Pin,
+	"/diagnose":          Diagnose,
+	"/routing/whitelist": Whitelist,
+	"/routing/blacklist": Blacklist,
+	"/routing/test":      TestRoute,
+	"/routing/balancer":  Balancer,
+	"/observatory":       Observatory,
+	"/watchdog":          Watchdog,
+	"/schedule":          Schedule,
+	"/":                  Root,
 }
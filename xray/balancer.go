@@ -0,0 +1,113 @@
+package xray
+
+import (
+	log "github.com/golang/glog"
+	"xray-helper/common"
+)
+
+// NamedBalancerTag 配置中 balancers 对应的负载均衡 tag
+func NamedBalancerTag(name string) string {
+	return "balancer-" + name
+}
+
+// namedPrefix 命名负载均衡的出站 tag 前缀，名称中没有 '_'，各前缀互不为前缀
+func namedPrefix(name string) string {
+	return "bal-" + name + "_"
+}
+
+func toBalancer(tag string, selector []string, bc common.BalancerConfig) Balancer {
+	b := Balancer{
+		Tag:         tag,
+		Selector:    selector,
+		Strategy:    BalancerStrategy{Type: bc.Strategy},
+		FallbackTag: bc.FallbackTag,
+	}
+	if bc.Expected > 0 || bc.MaxRTT != "" || bc.Tolerance > 0 || len(bc.Baselines) > 0 || len(bc.Costs) > 0 {
+		settings := &StrategySettings{
+			Expected:  bc.Expected,
+			MaxRTT:    bc.MaxRTT,
+			Tolerance: bc.Tolerance,
+			Baselines: bc.Baselines,
+		}
+		for _, c := range bc.Costs {
+			settings.Costs = append(settings.Costs, StrategyCost{Regexp: c.Regexp, Match: c.Match, Value: c.Value})
+		}
+		b.Strategy.Settings = settings
+	}
+	return b
+}
+
+// balancers 路由配置中的全部负载均衡
+func (app *XrayApp) balancers() []Balancer {
+	config := app.configSnapshot()
+	list := []Balancer{toBalancer("proxy-balancer", []string{"proxy"}, config.Balancer)}
+	if config.Test.Udp.Route {
+		list = append(list, toBalancer("proxy-udp-balancer", []string{"proxy_udp_"}, config.Balancer))
+	}
+	for _, nb := range config.Balancers {
+		list = append(list, toBalancer(NamedBalancerTag(nb.Name), []string{namedPrefix(nb.Name)}, nb.BalancerConfig))
+	}
+	return list
+}
+
+// observatorySubjects observatory 探测的出站 tag 前缀
+func (app *XrayApp) observatorySubjects() []string {
+	subjects := []string{"proxy"}
+	for _, nb := range app.config.Balancers {
+		subjects = append(subjects, namedPrefix(nb.Name))
+	}
+	return subjects
+}
+
+// proxyOutbounds selected 写入 proxy-balancer，candidates(按评分排序)中匹配的节点
+// 复制一份写入各命名负载均衡(含按站点检查结果选择的)；返回全部出站及成功转换的 selected
+func (app *XrayApp) proxyOutbounds(selected []*V2Ray, candidates []*V2Ray) ([]OutboundObject, []*V2Ray) {
+	var outbounds []OutboundObject
+	var written []*V2Ray
+	for _, v := range selected {
+		o, err := app.ProxyOutbound(v)
+		if err != nil {
+			log.Errorf("ProxyOutbound error %v", err)
+			continue
+		}
+		outbounds = append(outbounds, o)
+		written = append(written, v)
+	}
+	for _, nb := range app.config.Balancers {
+		var members []*V2Ray
+		for _, v := range candidates {
+			if len(members) >= nb.TopN {
+				break
+			}
+			if balancerMember(nb, v) && !matchNode(app.config.Selection.NeverInclude, v) {
+				members = append(members, v)
+			}
+		}
+		// 还没有站点检查结果或没有节点通过时负载均衡为空，由 fallbackTag 处理，不使用未通过检查的节点
+		if len(members) == 0 && nb.Site != "" {
+			log.Warningf("no node passed site %v, balancer %v uses fallback %v", nb.Site, NamedBalancerTag(nb.Name), nb.FallbackTag)
+		} else if len(members) == 0 {
+			log.Warningf("no node for balancer %v", NamedBalancerTag(nb.Name))
+		}
+		for _, v := range members {
+			o, err := app.TransferToOutbound(v, namedPrefix(nb.Name))
+			if err != nil {
+				log.Errorf("TransferToOutbound error %v", err)
+				continue
+			}
+			outbounds = append(outbounds, o)
+		}
+	}
+	return outbounds, written
+}
+
+// balancerMember 节点是否匹配命名负载均衡的 nodes 及 site
+func balancerMember(nb common.NamedBalancerConfig, v *V2Ray) bool {
+	if len(nb.Nodes) > 0 && !matchNode(nb.Nodes, v) {
+		return false
+	}
+	if nb.Site != "" && !v.Sites[nb.Site] {
+		return false
+	}
+	return true
+}
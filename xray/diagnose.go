@@ -0,0 +1,163 @@
+package xray
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+var ErrNodeNotFound = errors.New("node not found")
+
+// DiagnosisTiming 各阶段耗时(毫秒)，Connect 为连接测试实例本地入站，
+// Handshake 为 socks5 握手(包含节点解析并连接目标)，TTFB 与 Total 从开始请求计算。
+// 目标域名由节点在远端解析，无法单独计时；LocalDNS 为本机解析目标域名的耗时，仅供对比，
+// 目标为 IP 或本机解析失败时为空
+type DiagnosisTiming struct {
+	Startup   float64 `json:"startup"`
+	LocalDNS  float64 `json:"localDns,omitempty"`
+	Connect   float64 `json:"connect"`
+	Handshake float64 `json:"handshake"`
+	TLS       float64 `json:"tls"`
+	TTFB      float64 `json:"ttfb"`
+	Total     float64 `json:"total"`
+}
+
+// Diagnosis 经由单个节点的一次请求的结果
+type Diagnosis struct {
+	Key        string          `json:"key"`
+	Tag        string          `json:"tag"`
+	Url        string          `json:"url"`
+	Status     int             `json:"status,omitempty"`
+	Bytes      int64           `json:"bytes"`
+	Timing     DiagnosisTiming `json:"timing"`
+	Error      string          `json:"error,omitempty"`
+	ErrorClass string          `json:"errorClass,omitempty"`
+}
+
+// FindNode 按节点 key、tag 或备注查找当前订阅中的节点
+func (app *XrayApp) FindNode(id string) (*V2Ray, error) {
+	for _, v := range app.V2Rays {
+		if v.Key() == id {
+			return v, nil
+		}
+	}
+	for _, v := range app.V2Rays {
+		if v.GetTag("proxy_") == id || v.Ps == id {
+			return v, nil
+		}
+	}
+	return nil, ErrNodeNotFound
+}
+
+// Diagnose 为节点单独启动测试实例，请求 url 并记录各阶段耗时
+func (app *XrayApp) Diagnose(ctx context.Context, v *V2Ray, url string) Diagnosis {
+	d := Diagnosis{Key: v.Key(), Tag: v.GetTag("proxy_"), Url: url}
+	fail := func(err error) Diagnosis {
+		d.Error = err.Error()
+		d.ErrorClass = classifyError(err)
+		return d
+	}
+
+	start := time.Now()
+	inst, err := app.StartTestInstance(ctx, []*V2Ray{v})
+	if err != nil {
+		return fail(err)
+	}
+	defer inst.Stop()
+	d.Timing.Startup = msSince(start)
+	proxyAddr, err := inst.ProxyAddr(v)
+	if err != nil {
+		return fail(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(app.config.Test.ProbeTimeout)*time.Second)
+	defer cancel()
+	// 连接可能在请求失败返回后才结束，记录耗时与读取结果都需要加锁
+	var mu sync.Mutex
+	var connectStart, tlsStart, requestStart time.Time
+	record := func(f *float64, start time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		*f = msSince(start)
+	}
+	trace := &httptrace.ClientTrace{
+		ConnectStart:         func(string, string) { connectStart = time.Now() },
+		ConnectDone:          func(string, string, error) { record(&d.Timing.Connect, connectStart) },
+		TLSHandshakeStart:    func() { tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { record(&d.Timing.TLS, tlsStart) },
+		GotFirstResponseByte: func() { record(&d.Timing.TTFB, requestStart) },
+	}
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+			if err != nil {
+				return nil, err
+			}
+			if deadline, ok := ctx.Deadline(); ok {
+				conn.SetDeadline(deadline)
+			}
+			handshakeStart := time.Now()
+			_, err = socks5Handshake(conn, 1, addr)
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("proxy handshake: %w", err)
+			}
+			record(&d.Timing.Handshake, handshakeStart)
+			conn.SetDeadline(time.Time{})
+			return conn, nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	request, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, url, nil)
+	if err != nil {
+		return fail(err)
+	}
+	if host := request.URL.Hostname(); net.ParseIP(host) == nil {
+		dnsStart := time.Now()
+		_, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err == nil {
+			d.Timing.LocalDNS = msSince(dnsStart)
+		}
+	}
+	requestStart = time.Now()
+	response, err := client.Do(request)
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil {
+		d.Timing.Total = msSince(requestStart)
+		return fail(err)
+	}
+	defer response.Body.Close()
+	d.Status = response.StatusCode
+	d.Bytes, err = io.Copy(io.Discard, io.LimitReader(response.Body, maxProbeBodySize))
+	d.Timing.Total = msSince(requestStart)
+	if err != nil {
+		return fail(err)
+	}
+	return d
+}
+
+// ProbeUrl 诊断默认请求的地址，即第一个测试目标
+func (app *XrayApp) ProbeUrl() string {
+	return app.config.Test.Probes[0].Url
+}
+
+func msSince(t time.Time) float64 {
+	return float64(time.Since(t).Microseconds()) / 1000
+}
@@ -0,0 +1,268 @@
+package xray
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"fmt"
+	log "github.com/golang/glog"
+	"github.com/tidwall/gjson"
+	"github.com/xtls/xray-core/app/router"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExitInfo 节点的出口 IP 及所在地，Source 为国家的来源 echo/geoip
+type ExitInfo struct {
+	IP      string    `json:"ip"`
+	Country string    `json:"country,omitempty"`
+	ASN     string    `json:"asn,omitempty"`
+	Org     string    `json:"org,omitempty"`
+	Source  string    `json:"source,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+var asnPattern = regexp.MustCompile(`AS\d+`)
+
+// TestExitAll 查询本轮可用节点的出口，记录到 NodeResult.Exit 与 V2Ray.Exit
+func (app *XrayApp) TestExitAll(ctx context.Context, inst *TestInstance, results []NodeResult) {
+	var available []int
+	for i, r := range results {
+		if r.Available() {
+			available = append(available, i)
+		}
+	}
+	app.runTests(ctx, "exit", len(available), app.config.Test.Concurrency, func(ctx context.Context, j int) {
+		i := available[j]
+		v := results[i].Node
+		info, err := app.TestExit(ctx, inst, v)
+		if err != nil {
+			log.Errorf("exit test failed: %v %v", v.Ps, err)
+			return
+		}
+		if info.Country == "" {
+			info.Country = app.geoIP().country(net.ParseIP(info.IP))
+			if info.Country != "" {
+				info.Source = "geoip"
+			}
+		}
+		log.Infof("exit test complete, %v: %v %v %v", v.Ps, info.IP, info.Country, info.ASN)
+		results[i].Exit = &info
+		v.Exit = &info
+	})
+}
+
+// TestExit 经由测试实例中的节点请求 test.exit.url
+func (app *XrayApp) TestExit(ctx context.Context, inst *TestInstance, v *V2Ray) (ExitInfo, error) {
+	info := ExitInfo{Time: time.Now()}
+	config := app.config.Test.Exit
+	client, err := testClient(inst, v)
+	if err != nil {
+		return info, err
+	}
+	defer client.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.Timeout)*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, config.Url, nil)
+	if err != nil {
+		return info, err
+	}
+	request.Header.Set("Accept", "application/json")
+	response, err := client.Do(request)
+	if err != nil {
+		return info, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return info, fmt.Errorf("unexpected status %v", response.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, 64<<10))
+	if err != nil {
+		return info, err
+	}
+	err = parseExitInfo(&info, strings.TrimSpace(string(body)))
+	return info, err
+}
+
+// parseExitInfo 解析纯文本 IP 或常见 IP 查询服务(ipinfo.io、ip.sb、ip-api.com 等)的 json
+func parseExitInfo(info *ExitInfo, body string) error {
+	if ip := net.ParseIP(body); ip != nil {
+		info.IP = ip.String()
+		return nil
+	}
+	if !gjson.Valid(body) {
+		return fmt.Errorf("unrecognized response '%.64s'", body)
+	}
+	first := func(paths ...string) string {
+		for _, p := range paths {
+			if r := gjson.Get(body, p); r.Exists() && r.String() != "" {
+				return r.String()
+			}
+		}
+		return ""
+	}
+	ip := net.ParseIP(first("ip", "query", "origin", "ip_addr"))
+	if ip == nil {
+		return fmt.Errorf("no ip in response '%.64s'", body)
+	}
+	info.IP = ip.String()
+	info.Country = strings.ToUpper(first("country_code", "countryCode", "country_iso"))
+	if c := first("country"); info.Country == "" && len(c) == 2 {
+		info.Country = strings.ToUpper(c)
+	}
+	if info.Country != "" {
+		info.Source = "echo"
+	}
+	asn := first("asn", "as", "org")
+	if m := asnPattern.FindString(asn); m != "" {
+		info.ASN = m
+	} else if gjson.Get(body, "asn").Type == gjson.Number {
+		info.ASN = "AS" + asn
+	}
+	info.Org = first("asn_organization", "isp", "org")
+	return nil
+}
+
+// geoIPTable geoip.dat 中两位国家代码的条目，转换为按起始地址排序的地址段，
+// 进程内只加载一次，避免每轮测试都解析整个 geoip.dat
+type geoIPTable struct {
+	countries []string
+	v4        []geoIPRange4
+	v6        []geoIPRange6
+}
+
+// maxEnd 排序后该段及之前所有段的最大结束地址，用于处理嵌套的地址段
+type geoIPRange4 struct {
+	start, end, maxEnd uint32
+	country            uint16
+}
+
+type geoIPRange6 struct {
+	start, end, maxEnd [16]byte
+	country            uint16
+}
+
+// geoIP 加载失败时返回空表，查询结果为空
+func (app *XrayApp) geoIP() *geoIPTable {
+	app.geoipOnce.Do(func() {
+		list, err := loadGeoIP(filepath.Join(app.config.XrayAssetDir, "geoip.dat"))
+		if err != nil {
+			log.Errorf("load geoip.dat failed %v", err)
+			app.geoip = &geoIPTable{}
+			return
+		}
+		app.geoip = newGeoIPTable(list)
+	})
+	return app.geoip
+}
+
+func loadGeoIP(path string) (*router.GeoIPList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list router.GeoIPList
+	err = proto.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func newGeoIPTable(list *router.GeoIPList) *geoIPTable {
+	t := &geoIPTable{}
+	for _, entry := range list.GetEntry() {
+		if len(entry.GetCountryCode()) != 2 || entry.GetReverseMatch() {
+			continue
+		}
+		t.countries = append(t.countries, strings.ToUpper(entry.GetCountryCode()))
+		country := uint16(len(t.countries) - 1)
+		for _, cidr := range entry.GetCidr() {
+			ip := cidr.GetIp()
+			prefix := int(cidr.GetPrefix())
+			if prefix > len(ip)*8 {
+				continue
+			}
+			start, end := cidrRange(ip, prefix)
+			switch len(ip) {
+			case net.IPv4len:
+				t.v4 = append(t.v4, geoIPRange4{start: binary.BigEndian.Uint32(start), end: binary.BigEndian.Uint32(end), country: country})
+			case net.IPv6len:
+				r := geoIPRange6{country: country}
+				copy(r.start[:], start)
+				copy(r.end[:], end)
+				t.v6 = append(t.v6, r)
+			}
+		}
+	}
+	slices.SortFunc(t.v4, func(a, b geoIPRange4) int {
+		return cmp.Compare(a.start, b.start)
+	})
+	slices.SortFunc(t.v6, func(a, b geoIPRange6) int {
+		return bytes.Compare(a.start[:], b.start[:])
+	})
+	for i := range t.v4 {
+		t.v4[i].maxEnd = t.v4[i].end
+		if i > 0 && t.v4[i-1].maxEnd > t.v4[i].maxEnd {
+			t.v4[i].maxEnd = t.v4[i-1].maxEnd
+		}
+	}
+	for i := range t.v6 {
+		t.v6[i].maxEnd = t.v6[i].end
+		if i > 0 && bytes.Compare(t.v6[i-1].maxEnd[:], t.v6[i].maxEnd[:]) > 0 {
+			t.v6[i].maxEnd = t.v6[i-1].maxEnd
+		}
+	}
+	return t
+}
+
+// cidrRange 地址段的第一个和最后一个地址
+func cidrRange(ip []byte, prefix int) ([]byte, []byte) {
+	start := make([]byte, len(ip))
+	end := make([]byte, len(ip))
+	for i := range ip {
+		bits := min(max(prefix-i*8, 0), 8)
+		mask := byte(0xff << (8 - bits))
+		start[i] = ip[i] & mask
+		end[i] = ip[i] | ^mask
+	}
+	return start, end
+}
+
+// country 二分查找 ip 所属国家，没有匹配时为空；有嵌套时返回起始地址最大的地址段
+func (t *geoIPTable) country(ip net.IP) string {
+	if t == nil || ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		v := binary.BigEndian.Uint32(ip4)
+		i := sort.Search(len(t.v4), func(i int) bool { return t.v4[i].start > v }) - 1
+		for ; i >= 0 && t.v4[i].maxEnd >= v; i-- {
+			if t.v4[i].end >= v {
+				return t.countries[t.v4[i].country]
+			}
+		}
+		return ""
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ""
+	}
+	i := sort.Search(len(t.v6), func(i int) bool { return bytes.Compare(t.v6[i].start[:], ip16) > 0 }) - 1
+	for ; i >= 0 && bytes.Compare(t.v6[i].maxEnd[:], ip16) >= 0; i-- {
+		if bytes.Compare(t.v6[i].end[:], ip16) >= 0 {
+			return t.countries[t.v6[i].country]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,120 @@
+package xray
+
+import (
+	"github.com/xtls/xray-core/app/router"
+	"net"
+	"testing"
+)
+
+func TestParseExitInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    ExitInfo
+		wantErr bool
+	}{
+		{"plain ipv4", "1.2.3.4", ExitInfo{IP: "1.2.3.4"}, false},
+		{"plain ipv6", "2001:db8::1", ExitInfo{IP: "2001:db8::1"}, false},
+		{
+			"ipinfo", `{"ip":"1.2.3.4","country":"jp","org":"AS2516 KDDI CORPORATION"}`,
+			ExitInfo{IP: "1.2.3.4", Country: "JP", ASN: "AS2516", Org: "AS2516 KDDI CORPORATION", Source: "echo"}, false,
+		},
+		{
+			"ip.sb", `{"ip":"1.2.3.4","country_code":"HK","asn":4760,"asn_organization":"HKT Limited"}`,
+			ExitInfo{IP: "1.2.3.4", Country: "HK", ASN: "AS4760", Org: "HKT Limited", Source: "echo"}, false,
+		},
+		{
+			"ip-api", `{"query":"1.2.3.4","countryCode":"US","as":"AS15169 Google LLC","isp":"Google LLC"}`,
+			ExitInfo{IP: "1.2.3.4", Country: "US", ASN: "AS15169", Org: "Google LLC", Source: "echo"}, false,
+		},
+		{"full country name ignored", `{"ip":"1.2.3.4","country":"Japan"}`, ExitInfo{IP: "1.2.3.4"}, false},
+		{"no ip", `{"country":"JP"}`, ExitInfo{}, true},
+		{"not json", "<html>blocked</html>", ExitInfo{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got ExitInfo
+			err := parseExitInfo(&got, tt.body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseExitInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseExitInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeoIPTable(t *testing.T) {
+	cidr := func(s string) *router.CIDR {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := n.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		ones, _ := n.Mask.Size()
+		return &router.CIDR{Ip: ip, Prefix: uint32(ones)}
+	}
+	table := newGeoIPTable(&router.GeoIPList{Entry: []*router.GeoIP{
+		{CountryCode: "cn", Cidr: []*router.CIDR{cidr("1.0.0.0/8"), cidr("240e::/20")}},
+		// 嵌套在 1.0.0.0/8 中的更小地址段
+		{CountryCode: "jp", Cidr: []*router.CIDR{cidr("1.2.0.0/16"), cidr("2001:db8::/32")}},
+		{CountryCode: "us", Cidr: []*router.CIDR{cidr("8.8.8.0/24")}},
+		// 非国家条目及反向匹配不参与查询
+		{CountryCode: "private", Cidr: []*router.CIDR{cidr("10.0.0.0/8")}},
+		{CountryCode: "de", ReverseMatch: true, Cidr: []*router.CIDR{cidr("9.0.0.0/8")}},
+	}})
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"1.1.1.1", "CN"},
+		{"1.2.3.4", "JP"},
+		{"1.3.0.0", "CN"},
+		{"1.255.255.255", "CN"},
+		{"8.8.8.8", "US"},
+		{"8.8.9.1", ""},
+		{"10.0.0.1", ""},
+		{"9.9.9.9", ""},
+		{"0.0.0.1", ""},
+		{"255.255.255.255", ""},
+		{"240e:1::1", "CN"},
+		{"2001:db8::1", "JP"},
+		{"2001:db9::1", ""},
+		{"::ffff:1.2.3.4", "JP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := table.country(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("country(%v) = %q, want %q", tt.ip, got, tt.want)
+			}
+		})
+	}
+
+	var empty *geoIPTable
+	if got := empty.country(net.ParseIP("1.1.1.1")); got != "" {
+		t.Errorf("nil table country = %q, want empty", got)
+	}
+}
+
+func TestCidrRange(t *testing.T) {
+	tests := []struct {
+		ip         string
+		prefix     int
+		start, end string
+	}{
+		{"1.2.3.4", 24, "1.2.3.0", "1.2.3.255"},
+		{"1.2.3.4", 32, "1.2.3.4", "1.2.3.4"},
+		{"1.2.3.4", 0, "0.0.0.0", "255.255.255.255"},
+		{"10.200.0.0", 9, "10.128.0.0", "10.255.255.255"},
+	}
+	for _, tt := range tests {
+		start, end := cidrRange(net.ParseIP(tt.ip).To4(), tt.prefix)
+		if net.IP(start).String() != tt.start || net.IP(end).String() != tt.end {
+			t.Errorf("cidrRange(%v/%v) = %v-%v, want %v-%v", tt.ip, tt.prefix, net.IP(start), net.IP(end), tt.start, tt.end)
+		}
+	}
+}
@@ -1 +1,289 @@
 package xray
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/golang/glog"
+	"github.com/xtls/xray-core/app/observatory"
+	obscmd "github.com/xtls/xray-core/app/observatory/command"
+	"github.com/xtls/xray-core/app/proxyman/command"
+	"github.com/xtls/xray-core/app/router"
+	routercmd "github.com/xtls/xray-core/app/router/command"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/infra/conf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 单次 gRPC 调用超时
+const grpcTimeout = 5 * time.Second
+
+// GrpcClient xray api 的 gRPC 客户端
+type GrpcClient struct {
+	addr    string
+	conn    *grpc.ClientConn
+	handler command.HandlerServiceClient
+	routing routercmd.RoutingServiceClient
+	obs     obscmd.ObservatoryServiceClient
+}
+
+func NewGrpcClient(addr string) (*GrpcClient, error) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	return &GrpcClient{
+		addr:    addr,
+		conn:    conn,
+		handler: command.NewHandlerServiceClient(conn),
+		routing: routercmd.NewRoutingServiceClient(conn),
+		obs:     obscmd.NewObservatoryServiceClient(conn),
+	}, nil
+}
+
+func (c *GrpcClient) Close() error {
+	return c.conn.Close()
+}
+
+// AddOutbound 通过 HandlerService 添加出站，配置格式与配置文件相同
+func (c *GrpcClient) AddOutbound(ctx context.Context, outbound OutboundObject) error {
+	config, err := buildOutbound(outbound)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, grpcTimeout)
+	defer cancel()
+	_, err = c.handler.AddOutbound(ctx, &command.AddOutboundRequest{Outbound: config})
+	if err != nil {
+		return fmt.Errorf("add outbound %v: %w", outbound.Tag, err)
+	}
+	return nil
+}
+
+func (c *GrpcClient) RemoveOutbound(ctx context.Context, tag string) error {
+	ctx, cancel := context.WithTimeout(ctx, grpcTimeout)
+	defer cancel()
+	_, err := c.handler.RemoveOutbound(ctx, &command.RemoveOutboundRequest{Tag: tag})
+	if err != nil {
+		return fmt.Errorf("remove outbound %v: %w", tag, err)
+	}
+	return nil
+}
+
+// AddRule 通过 RoutingService 添加路由规则与负载均衡，shouldAppend 为 false 时替换全部规则
+func (c *GrpcClient) AddRule(ctx context.Context, config *router.Config, shouldAppend bool) error {
+	ctx, cancel := context.WithTimeout(ctx, grpcTimeout)
+	defer cancel()
+	_, err := c.routing.AddRule(ctx, &routercmd.AddRuleRequest{
+		Config:       serial.ToTypedMessage(config),
+		ShouldAppend: shouldAppend,
+	})
+	if err != nil {
+		return fmt.Errorf("add rule: %w", err)
+	}
+	return nil
+}
+
+func (c *GrpcClient) RemoveRule(ctx context.Context, ruleTag string) error {
+	ctx, cancel := context.WithTimeout(ctx, grpcTimeout)
+	defer cancel()
+	_, err := c.routing.RemoveRule(ctx, &routercmd.RemoveRuleRequest{RuleTag: ruleTag})
+	if err != nil {
+		return fmt.Errorf("remove rule %v: %w", ruleTag, err)
+	}
+	return nil
+}
+
+// TestRoute 返回 xray 对给定连接的路由结果
+func (c *GrpcClient) TestRoute(ctx context.Context, rc *routercmd.RoutingContext) (*routercmd.RoutingContext, error) {
+	ctx, cancel := context.WithTimeout(ctx, grpcTimeout)
+	defer cancel()
+	result, err := c.routing.TestRoute(ctx, &routercmd.TestRouteRequest{
+		RoutingContext: rc,
+		FieldSelectors: []string{"outbound"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("test route: %w", err)
+	}
+	return result, nil
+}
+
+func (c *GrpcClient) GetBalancerInfo(ctx context.Context, tag string) (*routercmd.BalancerMsg, error) {
+	ctx, cancel := context.WithTimeout(ctx, grpcTimeout)
+	defer cancel()
+	resp, err := c.routing.GetBalancerInfo(ctx, &routercmd.GetBalancerInfoRequest{Tag: tag})
+	if err != nil {
+		return nil, fmt.Errorf("get balancer info %v: %w", tag, err)
+	}
+	return resp.GetBalancer(), nil
+}
+
+// OverrideBalancerTarget 固定负载均衡的出站，target 为空时取消
+func (c *GrpcClient) OverrideBalancerTarget(ctx context.Context, tag string, target string) error {
+	ctx, cancel := context.WithTimeout(ctx, grpcTimeout)
+	defer cancel()
+	_, err := c.routing.OverrideBalancerTarget(ctx, &routercmd.OverrideBalancerTargetRequest{
+		BalancerTag: tag,
+		Target:      target,
+	})
+	if err != nil {
+		return fmt.Errorf("override balancer %v: %w", tag, err)
+	}
+	return nil
+}
+
+// GetOutboundStatus 返回 observatory 对各出站的探测结果
+func (c *GrpcClient) GetOutboundStatus(ctx context.Context) ([]*observatory.OutboundStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, grpcTimeout)
+	defer cancel()
+	resp, err := c.obs.GetOutboundStatus(ctx, &obscmd.GetOutboundStatusRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("get outbound status: %w", err)
+	}
+	return resp.GetStatus().GetStatus(), nil
+}
+
+// buildOutbound 将出站配置按 xray 的 json 配置解析方式转换为 protobuf
+func buildOutbound(outbound OutboundObject) (*core.OutboundHandlerConfig, error) {
+	data, err := json.Marshal(outbound)
+	if err != nil {
+		return nil, err
+	}
+	var detour conf.OutboundDetourConfig
+	err = json.Unmarshal(data, &detour)
+	if err != nil {
+		return nil, err
+	}
+	return detour.Build()
+}
+
+// Grpc 连接 xray api 的客户端，首次调用时创建；重新加载配置后 address/apiPort 变化时重新创建
+func (app *XrayApp) Grpc() (*GrpcClient, error) {
+	config := app.configSnapshot()
+	addr := net.JoinHostPort(config.Address, strconv.Itoa(int(config.ApiPort)))
+	app.grpcMu.Lock()
+	defer app.grpcMu.Unlock()
+	if app.grpcClient != nil {
+		if app.grpcClient.addr == addr {
+			return app.grpcClient, nil
+		}
+		err := app.grpcClient.Close()
+		if err != nil {
+			log.Errorf("close grpc client %v failed %v", app.grpcClient.addr, err)
+		}
+		app.grpcClient = nil
+	}
+	client, err := NewGrpcClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	app.grpcClient = client
+	return client, nil
+}
+
+// ApplyOutbounds 将正在运行的 xray 中的 proxy 出站更新为 outbounds，
+// 只增删有变化的出站，不中断其余连接
+func (app *XrayApp) ApplyOutbounds(ctx context.Context, outbounds []OutboundObject) error {
+	client, err := app.Grpc()
+	if err != nil {
+		return err
+	}
+	app.activeMu.Lock()
+	defer app.activeMu.Unlock()
+
+	wanted, err := outboundSums(outbounds)
+	if err != nil {
+		return err
+	}
+	for tag, sum := range app.activeTags {
+		if wanted[tag] == sum {
+			continue
+		}
+		err := client.RemoveOutbound(ctx, tag)
+		if err != nil {
+			return err
+		}
+		delete(app.activeTags, tag)
+	}
+	for _, o := range outbounds {
+		if _, ok := app.activeTags[o.Tag]; ok {
+			continue
+		}
+		err := client.AddOutbound(ctx, o)
+		if err != nil {
+			return err
+		}
+		app.activeTags[o.Tag] = wanted[o.Tag]
+	}
+	return nil
+}
+
+// outboundsUnchanged 正在运行的 xray 中的 proxy 出站是否与 outbounds 完全相同
+func (app *XrayApp) outboundsUnchanged(outbounds []OutboundObject) bool {
+	wanted, err := outboundSums(outbounds)
+	if err != nil {
+		return false
+	}
+	app.activeMu.Lock()
+	defer app.activeMu.Unlock()
+	if len(wanted) != len(app.activeTags) {
+		return false
+	}
+	for tag, sum := range wanted {
+		if app.activeTags[tag] != sum {
+			return false
+		}
+	}
+	return true
+}
+
+// outboundSums 出站 tag 到配置文件内容摘要
+func outboundSums(outbounds []OutboundObject) (map[string]string, error) {
+	sums := make(map[string]string)
+	for _, o := range outbounds {
+		data, err := proxyOutboundData(o)
+		if err != nil {
+			return nil, err
+		}
+		sums[o.Tag] = dataSum(data)
+	}
+	return sums, nil
+}
+
+func dataSum(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadActiveTags 记录 xray 将从配置文件加载的 proxy 出站，在启动 xray 前调用
+func (app *XrayApp) loadActiveTags() error {
+	files, err := os.ReadDir(app.config.XrayConfigDir)
+	if err != nil {
+		return err
+	}
+	app.activeMu.Lock()
+	defer app.activeMu.Unlock()
+	app.activeTags = make(map[string]string)
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, PrefixProxy) || !strings.HasSuffix(name, proxyFileSuffix) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(app.config.XrayConfigDir, name))
+		if err != nil {
+			return err
+		}
+		app.activeTags[strings.TrimSuffix(strings.TrimPrefix(name, PrefixProxy), proxyFileSuffix)] = dataSum(data)
+	}
+	return nil
+}
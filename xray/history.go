@@ -0,0 +1,263 @@
+package xray
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	log "github.com/golang/glog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"xray-helper/common"
+)
+
+// 测试失败的错误分类
+const (
+	ErrClassNotTested = "not_tested"
+	ErrClassTimeout   = "timeout"
+	ErrClassDns       = "dns"
+	ErrClassRefused   = "refused"
+	ErrClassReset     = "reset"
+	ErrClassEOF       = "eof"
+	ErrClassTLS       = "tls"
+	ErrClassStatus    = "status"
+	ErrClassBody      = "body"
+	ErrClassOther     = "other"
+	// 隔离中没有测试
+	ErrClassQuarantined = "quarantined"
+)
+
+// 超过该时间没有出现在订阅中的节点历史会被清理
+const historyRetention = 7 * 24 * time.Hour
+
+// TestRecord 一次测试的记录，Latency 为中位延迟(毫秒)，失败为 -1
+type TestRecord struct {
+	Time       time.Time `json:"time"`
+	Latency    int       `json:"latency"`
+	ErrorClass string    `json:"errorClass,omitempty"`
+}
+
+// NodeHistory 节点的测试历史，Score 为成功测试评分的指数加权平均，
+// SuccessRate 为成功率的指数加权平均
+type NodeHistory struct {
+	Key         string    `json:"key"`
+	Tag         string    `json:"tag"`
+	Rounds      int       `json:"rounds"`
+	Score       float64   `json:"score"`
+	SuccessRate float64   `json:"successRate"`
+	LastSeen    time.Time `json:"lastSeen"`
+	Exit        *ExitInfo `json:"exit,omitempty"`
+	// UDP 最近一次 UDP 测试是否支持，未测试时为空
+	UDP *bool `json:"udp,omitempty"`
+	// Sites 最近一次站点检查结果
+	Sites      map[string]SiteResult `json:"sites,omitempty"`
+	Quarantine Quarantine            `json:"quarantine"`
+	Records    []TestRecord          `json:"records"`
+}
+
+// HistoryStore 节点测试历史，以 json 文件保存在 dataDir 下
+type HistoryStore struct {
+	mu    sync.Mutex
+	path  string
+	Nodes map[string]*NodeHistory `json:"nodes"`
+}
+
+func OpenHistoryStore(dataDir string) (*HistoryStore, error) {
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	h := &HistoryStore{
+		path:  filepath.Join(dataDir, "history.json"),
+		Nodes: map[string]*NodeHistory{},
+	}
+	content := readFromFile(h.path)
+	if content == "" {
+		return h, nil
+	}
+	err = json.Unmarshal([]byte(content), h)
+	if err != nil {
+		return nil, err
+	}
+	if h.Nodes == nil {
+		h.Nodes = map[string]*NodeHistory{}
+	}
+	return h, nil
+}
+
+func (h *HistoryStore) Save() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	data, err := json.MarshalIndent(h, "", "    ")
+	if err != nil {
+		return err
+	}
+	// 先写临时文件再改名，避免写到一半时文件损坏
+	tmp := h.path + ".tmp"
+	err = writeToFile(string(data), tmp)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+// Record 记录一轮测试结果并更新加权评分，未测试的节点不记录
+func (h *HistoryStore) Record(results []NodeResult, config common.HistoryConfig, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	alpha := config.Alpha
+	for _, r := range results {
+		if r.ErrorClass == ErrClassNotTested {
+			continue
+		}
+		if r.ErrorClass == ErrClassQuarantined {
+			if n, ok := h.Nodes[r.Node.Key()]; ok {
+				n.LastSeen = now
+			}
+			continue
+		}
+		key := r.Node.Key()
+		n, ok := h.Nodes[key]
+		if !ok {
+			n = &NodeHistory{Key: key}
+			h.Nodes[key] = n
+		}
+		n.Tag = r.Tag
+		n.LastSeen = now
+		if r.Exit != nil {
+			n.Exit = r.Exit
+		}
+		if r.Sites != nil {
+			n.Sites = r.Sites
+		}
+
+		record := TestRecord{Time: now, Latency: -1, ErrorClass: r.ErrorClass}
+		success := 0.0
+		if r.Available() {
+			record.Latency = r.Latency.Median
+			success = 1
+		}
+		n.Records = append(n.Records, record)
+		if len(n.Records) > config.MaxRecords {
+			n.Records = n.Records[len(n.Records)-config.MaxRecords:]
+		}
+
+		if n.Rounds == 0 {
+			n.SuccessRate = success
+		} else {
+			n.SuccessRate = alpha*success + (1-alpha)*n.SuccessRate
+		}
+		if r.Available() {
+			if n.Score == 0 {
+				n.Score = r.Latency.Score
+			} else {
+				n.Score = alpha*r.Latency.Score + (1-alpha)*n.Score
+			}
+		}
+		n.Rounds++
+	}
+	for key, n := range h.Nodes {
+		if now.Sub(n.LastSeen) > historyRetention {
+			delete(h.Nodes, key)
+		}
+	}
+}
+
+// RecordUDP 记录本轮 UDP 测试结果，没有 UDP 结果(未测试或测试被中断)的节点不变
+func (h *HistoryStore) RecordUDP(results []NodeResult) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range results {
+		n, ok := h.Nodes[r.Node.Key()]
+		if !ok || r.UDP == nil {
+			continue
+		}
+		supported := r.UDP.Supported
+		n.UDP = &supported
+	}
+}
+
+func (h *HistoryStore) Get(key string) (NodeHistory, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n, ok := h.Nodes[key]
+	if !ok {
+		return NodeHistory{}, false
+	}
+	return *n, true
+}
+
+func (h *HistoryStore) All() []NodeHistory {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var all []NodeHistory
+	for _, n := range h.Nodes {
+		all = append(all, *n)
+	}
+	return all
+}
+
+// EffectiveScore 历史评分加上失败率惩罚，越小越好
+func (n NodeHistory) EffectiveScore(weights common.ScoreConfig) float64 {
+	return n.Score + (1-n.SuccessRate)*weights.Loss
+}
+
+// classifyError 将测试错误归类，便于统计
+func classifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	msg := err.Error()
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrClassTimeout
+	case errors.As(err, &dnsErr):
+		return ErrClassDns
+	case strings.Contains(msg, "connection refused"):
+		return ErrClassRefused
+	case strings.Contains(msg, "connection reset"):
+		return ErrClassReset
+	case strings.Contains(msg, "EOF"):
+		return ErrClassEOF
+	case strings.Contains(msg, "tls:") || strings.Contains(msg, "x509:"):
+		return ErrClassTLS
+	case strings.HasPrefix(msg, "unexpected status"):
+		return ErrClassStatus
+	case strings.HasPrefix(msg, "body does not contain"), strings.HasPrefix(msg, "body contains"):
+		return ErrClassBody
+	}
+	return ErrClassOther
+}
+
+// restoreNodeAttrs 重新解析订阅得到的节点没有测试结果，从测试历史中恢复 UDP 支持、出口及站点检查结果，
+// 避免下一轮测试完成前 proxy-udp-balancer 为空、按站点选择的负载均衡使用未通过检查的节点
+func (app *XrayApp) restoreNodeAttrs(v2rays []*V2Ray) {
+	history, err := app.History()
+	if err != nil {
+		log.Errorf("load test history failed %v", err)
+		return
+	}
+	for _, v := range v2rays {
+		h, ok := history.Get(v.Key())
+		if !ok {
+			continue
+		}
+		if h.UDP != nil {
+			v.UDP = *h.UDP
+		}
+		if h.Exit != nil {
+			v.Exit = h.Exit
+		}
+		if h.Sites != nil {
+			v.Sites = make(map[string]bool, len(h.Sites))
+			for name, r := range h.Sites {
+				v.Sites[name] = r.Ok
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package xray
+
+import (
+	"math"
+	"testing"
+	"time"
+	"xray-helper/common"
+)
+
+// testNode 只有备注与地址不同的节点，key 互不相同
+func testNode(ps string) *V2Ray {
+	return &V2Ray{Ps: ps, Add: ps + ".example.com", Port: 443, Protocol: "vmess"}
+}
+
+// passed 本轮可用的结果，评分等于中位延迟
+func passed(v *V2Ray, median int) NodeResult {
+	return NodeResult{
+		Node:    v,
+		Tag:     v.GetTag("proxy_"),
+		Latency: LatencyStats{Samples: 3, Median: median, Score: float64(median)},
+	}
+}
+
+func failed(v *V2Ray) NodeResult {
+	return NodeResult{
+		Node:       v,
+		Tag:        v.GetTag("proxy_"),
+		Latency:    LatencyStats{Samples: 3, Loss: 1},
+		Error:      "timeout",
+		ErrorClass: ErrClassTimeout,
+	}
+}
+
+func notTested(v *V2Ray) NodeResult {
+	return NodeResult{Node: v, Tag: v.GetTag("proxy_"), Error: "not tested", ErrorClass: ErrClassNotTested}
+}
+
+func newTestHistory() *HistoryStore {
+	return &HistoryStore{Nodes: map[string]*NodeHistory{}}
+}
+
+func TestHistoryRecord(t *testing.T) {
+	config := common.HistoryConfig{Alpha: 0.5, MaxRecords: 2}
+	weights := common.ScoreConfig{Loss: 1000}
+	a := testNode("a")
+	tests := []struct {
+		name        string
+		rounds      []NodeResult
+		score       float64
+		successRate float64
+		records     int
+		effective   float64
+	}{
+		{"first success", []NodeResult{passed(a, 100)}, 100, 1, 1, 100},
+		{"first failure", []NodeResult{failed(a)}, 0, 0, 1, 1000},
+		{"ewma of scores", []NodeResult{passed(a, 100), passed(a, 200)}, 150, 1, 2, 150},
+		{"failure keeps score", []NodeResult{passed(a, 100), failed(a)}, 100, 0.5, 2, 600},
+		{"records trimmed", []NodeResult{passed(a, 100), passed(a, 100), failed(a)}, 100, 0.5, 2, 600},
+		{"not tested ignored", []NodeResult{passed(a, 100), notTested(a)}, 100, 1, 1, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHistory()
+			now := time.Now()
+			for i, r := range tt.rounds {
+				h.Record([]NodeResult{r}, config, now.Add(time.Duration(i)*time.Minute))
+			}
+			n, ok := h.Get(a.Key())
+			if !ok {
+				t.Fatal("no history recorded")
+			}
+			if n.Score != tt.score || n.SuccessRate != tt.successRate || len(n.Records) != tt.records {
+				t.Errorf("score %v success rate %v records %v, want %v %v %v",
+					n.Score, n.SuccessRate, len(n.Records), tt.score, tt.successRate, tt.records)
+			}
+			if got := n.EffectiveScore(weights); math.Abs(got-tt.effective) > 1e-9 {
+				t.Errorf("EffectiveScore() = %v, want %v", got, tt.effective)
+			}
+		})
+	}
+}
+
+func TestHistoryRecordRetention(t *testing.T) {
+	config := common.HistoryConfig{Alpha: 0.3, MaxRecords: 10}
+	a, b := testNode("a"), testNode("b")
+	h := newTestHistory()
+	now := time.Now()
+	h.Record([]NodeResult{passed(a, 100), passed(b, 100)}, config, now.Add(-historyRetention-time.Hour))
+	h.Record([]NodeResult{passed(a, 100)}, config, now)
+	if _, ok := h.Get(a.Key()); !ok {
+		t.Error("node seen this round was removed")
+	}
+	if _, ok := h.Get(b.Key()); ok {
+		t.Error("node not seen within retention was kept")
+	}
+}
+
+func TestHistoryRecordUDP(t *testing.T) {
+	config := common.HistoryConfig{Alpha: 0.3, MaxRecords: 10}
+	a := testNode("a")
+	yes, no := true, false
+	tests := []struct {
+		name   string
+		before *bool
+		udp    *UDPResult
+		want   *bool
+	}{
+		{"supported", nil, &UDPResult{Supported: true}, &yes},
+		{"unsupported", &yes, &UDPResult{Error: "timeout"}, &no},
+		{"no result keeps previous", &yes, nil, &yes},
+		{"no result stays unknown", nil, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHistory()
+			h.Record([]NodeResult{passed(a, 100)}, config, time.Now())
+			h.Nodes[a.Key()].UDP = tt.before
+			r := passed(a, 100)
+			r.UDP = tt.udp
+			h.RecordUDP([]NodeResult{r})
+			got := h.Nodes[a.Key()].UDP
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("UDP = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package xray
+
+import (
+	"encoding/json"
+	log "github.com/golang/glog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SelectedState 最近一次测试选出的节点，启动时先使用这些节点，测试完成后替换
+type SelectedState struct {
+	Time time.Time `json:"time"`
+	// Selected proxy-balancer 的节点 key，Candidates 命名负载均衡的候选节点 key，按评分排序
+	Selected   []string `json:"selected"`
+	Candidates []string `json:"candidates"`
+}
+
+func (app *XrayApp) selectedStatePath() string {
+	return filepath.Join(app.config.DataDir, "selected.json")
+}
+
+// saveSelected 保存本轮测试选出的节点
+func (app *XrayApp) saveSelected(selected []*V2Ray, candidates []*V2Ray) error {
+	state := SelectedState{
+		Time:       time.Now(),
+		Selected:   nodeKeys(selected),
+		Candidates: nodeKeys(candidates),
+	}
+	data, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(app.config.DataDir, 0755)
+	if err != nil {
+		return err
+	}
+	path := app.selectedStatePath()
+	tmp := path + ".tmp"
+	err = writeToFile(string(data), tmp)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// restoreSelected 从 v2rays 中找出上次保存的节点；没有保存或这些节点都已不在订阅中时返回 v2rays
+func (app *XrayApp) restoreSelected(v2rays []*V2Ray) (selected []*V2Ray, candidates []*V2Ray) {
+	content := readFromFile(app.selectedStatePath())
+	if content == "" {
+		return v2rays, v2rays
+	}
+	var state SelectedState
+	err := json.Unmarshal([]byte(content), &state)
+	if err != nil {
+		log.Errorf("load last selected nodes failed %v", err)
+		return v2rays, v2rays
+	}
+	selected = findNodes(v2rays, state.Selected)
+	if len(selected) == 0 {
+		return v2rays, v2rays
+	}
+	candidates = findNodes(v2rays, state.Candidates)
+	log.Infof("restore %v last selected nodes from %v", len(selected), state.Time.Format(time.DateTime))
+	return selected, candidates
+}
+
+func nodeKeys(v2rays []*V2Ray) []string {
+	keys := make([]string, len(v2rays))
+	for i, v := range v2rays {
+		keys[i] = v.Key()
+	}
+	return keys
+}
+
+// findNodes 按 keys 的顺序找出 v2rays 中的节点，忽略找不到的
+func findNodes(v2rays []*V2Ray, keys []string) []*V2Ray {
+	byKey := make(map[string]*V2Ray, len(v2rays))
+	for _, v := range v2rays {
+		byKey[v.Key()] = v
+	}
+	var found []*V2Ray
+	for _, k := range keys {
+		if v, ok := byKey[k]; ok {
+			found = append(found, v)
+		}
+	}
+	return found
+}
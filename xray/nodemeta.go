@@ -0,0 +1,299 @@
+package xray
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/golang/glog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+var ErrNoNodeToPin = errors.New("no available node to pin")
+
+// NodeMeta 用户为节点添加的标签与备注
+type NodeMeta struct {
+	Labels []string `json:"labels,omitempty"`
+	Note   string   `json:"note,omitempty"`
+}
+
+// Pin 固定 proxy-balancer 只使用一个节点(key)或带有某个标签的节点，
+// 固定的节点测试全部失败时自动取消
+type Pin struct {
+	Node  string    `json:"node,omitempty"`
+	Label string    `json:"label,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// NodeMetaStore 节点标签、备注与固定设置，按节点 key 以 json 文件保存在 dataDir 下，
+// 不随订阅中的备注变化
+type NodeMetaStore struct {
+	mu    sync.Mutex
+	path  string
+	Nodes map[string]*NodeMeta `json:"nodes"`
+	Pin   *Pin                 `json:"pin,omitempty"`
+}
+
+// NodeInfo 订阅中的节点及其标签、备注
+type NodeInfo struct {
+	Key          string `json:"key"`
+	Tag          string `json:"tag"`
+	Subscription string `json:"subscription"`
+	NodeMeta
+	Pinned   bool `json:"pinned"`
+	Selected bool `json:"selected"`
+}
+
+func OpenNodeMetaStore(dataDir string) (*NodeMetaStore, error) {
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	s := &NodeMetaStore{
+		path:  filepath.Join(dataDir, "nodes.json"),
+		Nodes: map[string]*NodeMeta{},
+	}
+	content := readFromFile(s.path)
+	if content == "" {
+		return s, nil
+	}
+	err = json.Unmarshal([]byte(content), s)
+	if err != nil {
+		return nil, err
+	}
+	if s.Nodes == nil {
+		s.Nodes = map[string]*NodeMeta{}
+	}
+	return s, nil
+}
+
+func (s *NodeMetaStore) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	err = writeToFile(string(data), tmp)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *NodeMetaStore) Get(key string) NodeMeta {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.Nodes[key]
+	if !ok {
+		return NodeMeta{}
+	}
+	return NodeMeta{Labels: slices.Clone(m.Labels), Note: m.Note}
+}
+
+// Update 为节点增删标签，note 不为 nil 时替换备注；没有标签和备注的节点不保存
+func (s *NodeMetaStore) Update(key string, add []string, remove []string, note *string) NodeMeta {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.Nodes[key]
+	if !ok {
+		m = &NodeMeta{}
+	}
+	for _, l := range add {
+		if !slices.Contains(m.Labels, l) {
+			m.Labels = append(m.Labels, l)
+		}
+	}
+	m.Labels = slices.DeleteFunc(m.Labels, func(l string) bool {
+		return slices.Contains(remove, l)
+	})
+	if note != nil {
+		m.Note = *note
+	}
+	if len(m.Labels) == 0 && m.Note == "" {
+		delete(s.Nodes, key)
+	} else {
+		s.Nodes[key] = m
+	}
+	return NodeMeta{Labels: slices.Clone(m.Labels), Note: m.Note}
+}
+
+func (s *NodeMetaStore) GetPin() *Pin {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Pin == nil {
+		return nil
+	}
+	p := *s.Pin
+	return &p
+}
+
+func (s *NodeMetaStore) SetPin(p *Pin) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Pin = p
+}
+
+// pinned 节点是否被固定
+func (s *NodeMetaStore) pinned(v *V2Ray) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Pin == nil {
+		return false
+	}
+	if s.Pin.Node != "" {
+		return s.Pin.Node == v.Key()
+	}
+	m, ok := s.Nodes[v.Key()]
+	return ok && slices.Contains(m.Labels, s.Pin.Label)
+}
+
+// Pinned v2rays 中被固定的节点，没有固定时返回 nil
+func (s *NodeMetaStore) Pinned(v2rays []*V2Ray) []*V2Ray {
+	var pinned []*V2Ray
+	for _, v := range v2rays {
+		if s.pinned(v) {
+			pinned = append(pinned, v)
+		}
+	}
+	return pinned
+}
+
+func (app *XrayApp) NodeMeta() (*NodeMetaStore, error) {
+	app.metaMu.Lock()
+	defer app.metaMu.Unlock()
+	if app.meta != nil {
+		return app.meta, nil
+	}
+	meta, err := OpenNodeMetaStore(app.config.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	app.meta = meta
+	return meta, nil
+}
+
+// Nodes 订阅中的所有节点，label 不为空时只返回带有该标签的节点
+func (app *XrayApp) Nodes(label string) ([]NodeInfo, error) {
+	meta, err := app.NodeMeta()
+	if err != nil {
+		return nil, err
+	}
+	selected := make(map[string]bool)
+	for _, v := range app.Selected {
+		selected[v.Key()] = true
+	}
+	var nodes []NodeInfo
+	for _, v := range app.V2Rays {
+		m := meta.Get(v.Key())
+		if label != "" && !slices.Contains(m.Labels, label) {
+			continue
+		}
+		nodes = append(nodes, NodeInfo{
+			Key:          v.Key(),
+			Tag:          v.GetTag("proxy_"),
+			Subscription: v.Subscription,
+			NodeMeta:     m,
+			Pinned:       meta.pinned(v),
+			Selected:     selected[v.Key()],
+		})
+	}
+	return nodes, nil
+}
+
+// UpdateNodeMeta 为节点增删标签或修改备注并保存
+func (app *XrayApp) UpdateNodeMeta(v *V2Ray, add []string, remove []string, note *string) (NodeMeta, error) {
+	meta, err := app.NodeMeta()
+	if err != nil {
+		return NodeMeta{}, err
+	}
+	m := meta.Update(v.Key(), add, remove, note)
+	return m, meta.Save()
+}
+
+// PinNodes 固定 proxy-balancer 只使用指定节点或带有 label 的节点并立即生效，正在进行的测试会被取消；
+// node 与 label 都为空时取消固定，重新测试后按选择策略选择节点
+func (app *XrayApp) PinNodes(node string, label string) (*Pin, error) {
+	meta, err := app.NodeMeta()
+	if err != nil {
+		return nil, err
+	}
+	if node == "" && label == "" {
+		meta.SetPin(nil)
+		err = meta.Save()
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("nodes unpinned")
+		go func() {
+			err := app.TestAll()
+			if err != nil {
+				log.Errorf("test after unpin failed %v", err)
+			}
+		}()
+		return nil, nil
+	}
+
+	// 取消正在进行的测试并等待它结束，避免测试选出的节点覆盖固定的节点
+	app.CancelTest()
+	app.testMu.Lock()
+	defer app.testMu.Unlock()
+
+	pin := &Pin{Label: label, Time: time.Now()}
+	if node != "" {
+		v, err := app.FindNode(node)
+		if err != nil {
+			return nil, err
+		}
+		pin = &Pin{Node: v.Key(), Time: time.Now()}
+	}
+	old := meta.GetPin()
+	meta.SetPin(pin)
+	pinned := meta.Pinned(app.withoutQuarantined(app.V2Rays))
+	if len(pinned) == 0 {
+		meta.SetPin(old)
+		return nil, ErrNoNodeToPin
+	}
+	err = meta.Save()
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("pin %v nodes, node '%v' label '%v'", len(pinned), pin.Node, pin.Label)
+	return pin, app.UpdateProxyOutbounds(pinned, app.candidates)
+}
+
+// PinStatus 当前固定设置，没有固定时为 nil
+func (app *XrayApp) PinStatus() (*Pin, error) {
+	meta, err := app.NodeMeta()
+	if err != nil {
+		return nil, err
+	}
+	return meta.GetPin(), nil
+}
+
+// pinnedNodes v2rays 中被固定的节点；有固定但都不在 v2rays 中时，clear 为 true 则取消固定
+func (app *XrayApp) pinnedNodes(v2rays []*V2Ray, clear bool) []*V2Ray {
+	meta, err := app.NodeMeta()
+	if err != nil {
+		log.Errorf("load node meta failed %v", err)
+		return nil
+	}
+	pin := meta.GetPin()
+	if pin == nil {
+		return nil
+	}
+	pinned := meta.Pinned(v2rays)
+	if len(pinned) > 0 || !clear {
+		return pinned
+	}
+	log.Warningf("pinned nodes unavailable, unpin node '%v' label '%v'", pin.Node, pin.Label)
+	meta.SetPin(nil)
+	err = meta.Save()
+	if err != nil {
+		log.Errorf("save node meta failed %v", err)
+	}
+	return nil
+}
@@ -12,21 +12,44 @@ type ObservatoryItem struct {
 	Settings Observatory `json:"settings"`
 }
 type Observatory struct {
-	SubjectSelector []string `json:"subjectSelector"`
-	ProbeURL        string   `json:"probeURL,omitempty"`
-	ProbeInterval   string   `json:"probeInterval,omitempty"`
+	SubjectSelector   []string `json:"subjectSelector"`
+	ProbeURL          string   `json:"probeURL,omitempty"`
+	ProbeInterval     string   `json:"probeInterval,omitempty"`
+	EnableConcurrency bool     `json:"enableConcurrency,omitempty"`
+}
+type BurstObservatory struct {
+	SubjectSelector []string    `json:"subjectSelector"`
+	PingConfig      *PingConfig `json:"pingConfig,omitempty"`
+}
+type PingConfig struct {
+	Destination  string `json:"destination,omitempty"`
+	Connectivity string `json:"connectivity,omitempty"`
+	Interval     string `json:"interval,omitempty"`
+	Sampling     int    `json:"sampling,omitempty"`
+	Timeout      string `json:"timeout,omitempty"`
 }
 type Balancer struct {
-	Tag      string           `json:"tag"`
-	Selector []string         `json:"selector"`
-	Strategy BalancerStrategy `json:"strategy"`
+	Tag         string           `json:"tag"`
+	Selector    []string         `json:"selector"`
+	Strategy    BalancerStrategy `json:"strategy"`
+	FallbackTag string           `json:"fallbackTag,omitempty"`
 }
 type BalancerStrategy struct {
 	Type     string            `json:"type"`
 	Settings *StrategySettings `json:"settings,omitempty"`
 }
 type StrategySettings struct {
-	ObserverTag string `json:"observerTag"`
+	ObserverTag string         `json:"observerTag,omitempty"`
+	Expected    int            `json:"expected,omitempty"`
+	MaxRTT      string         `json:"maxRTT,omitempty"`
+	Tolerance   float64        `json:"tolerance,omitempty"`
+	Baselines   []string       `json:"baselines,omitempty"`
+	Costs       []StrategyCost `json:"costs,omitempty"`
+}
+type StrategyCost struct {
+	Regexp bool    `json:"regexp,omitempty"`
+	Match  string  `json:"match"`
+	Value  float32 `json:"value"`
 }
 type FakeDns struct {
 	IpPool   string `json:"ipPool"`
@@ -118,6 +141,18 @@ type Settings struct {
 	Network        string      `json:"network,omitempty"`
 	Redirect       string      `json:"redirect,omitempty"`
 	UserLevel      *int        `json:"userLevel,omitempty"`
+	Fragment       *Fragment   `json:"fragment,omitempty"`
+	Noises         []Noise     `json:"noises,omitempty"`
+}
+type Fragment struct {
+	Packets  string `json:"packets,omitempty"`
+	Length   string `json:"length,omitempty"`
+	Interval string `json:"interval,omitempty"`
+}
+type Noise struct {
+	Type   string `json:"type"`
+	Packet string `json:"packet"`
+	Delay  string `json:"delay,omitempty"`
 }
 type TLSSettings struct {
 	AllowInsecure                    bool          `json:"allowInsecure"`
@@ -163,10 +198,13 @@ type GrpcSettings struct {
 	ServiceName string `json:"serviceName"`
 }
 type Sockopt struct {
-	Mark        *int    `json:"mark,omitempty"`
-	Tos         *int    `json:"tos,omitempty"`
-	TCPFastOpen *bool   `json:"tcpFastOpen,omitempty"`
-	Tproxy      *string `json:"tproxy,omitempty"`
+	Mark                 *int    `json:"mark,omitempty"`
+	Tos                  *int    `json:"tos,omitempty"`
+	TCPFastOpen          *bool   `json:"tcpFastOpen,omitempty"`
+	Tproxy               *string `json:"tproxy,omitempty"`
+	Interface            string  `json:"interface,omitempty"`
+	DomainStrategy       string  `json:"domainStrategy,omitempty"`
+	TCPKeepAliveInterval *int    `json:"tcpKeepAliveInterval,omitempty"`
 }
 type Mux struct {
 	Enabled     bool `json:"enabled"`
@@ -0,0 +1,67 @@
+package xray
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+var ErrObservatoryDisabled = errors.New("observatory not enabled")
+
+// OutboundStatus observatory 对一个 proxy 出站的最新探测结果，Delay 单位毫秒
+type OutboundStatus struct {
+	Tag       string    `json:"tag"`
+	Alive     bool      `json:"alive"`
+	Delay     int64     `json:"delay"`
+	LastError string    `json:"lastError,omitempty"`
+	LastSeen  time.Time `json:"lastSeen,omitempty"`
+	LastTry   time.Time `json:"lastTry,omitempty"`
+	// 以下仅 burstObservatory 有
+	Samples   int64 `json:"samples,omitempty"`
+	Fails     int64 `json:"fails,omitempty"`
+	Deviation int64 `json:"deviation,omitempty"`
+}
+
+// ObservatoryStatus 各 proxy 出站的探测状态，可用的按延迟排在前面
+func (app *XrayApp) ObservatoryStatus(ctx context.Context) ([]OutboundStatus, error) {
+	if !app.config.Observatory.Enabled {
+		return nil, ErrObservatoryDisabled
+	}
+	client, err := app.Grpc()
+	if err != nil {
+		return nil, err
+	}
+	list, err := client.GetOutboundStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]OutboundStatus, 0, len(list))
+	for _, s := range list {
+		o := OutboundStatus{
+			Tag:       s.GetOutboundTag(),
+			Alive:     s.GetAlive(),
+			Delay:     s.GetDelay(),
+			LastError: s.GetLastErrorReason(),
+		}
+		if s.GetLastSeenTime() > 0 {
+			o.LastSeen = time.Unix(s.GetLastSeenTime(), 0)
+		}
+		if s.GetLastTryTime() > 0 {
+			o.LastTry = time.Unix(s.GetLastTryTime(), 0)
+		}
+		if hp := s.GetHealthPing(); hp != nil {
+			o.Samples = hp.GetAll()
+			o.Fails = hp.GetFail()
+			o.Deviation = hp.GetDeviation()
+		}
+		status = append(status, o)
+	}
+	sort.SliceStable(status, func(i, j int) bool {
+		if status[i].Alive != status[j].Alive {
+			return status[i].Alive
+		}
+		return status[i].Delay < status[j].Delay
+	})
+	return status, nil
+}
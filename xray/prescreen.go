@@ -0,0 +1,154 @@
+package xray
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	log "github.com/golang/glog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PrescreenResult 直接连接节点服务器的结果，耗时单位为毫秒
+type PrescreenResult struct {
+	Key     string `json:"key"`
+	Tag     string `json:"tag"`
+	Passed  bool   `json:"passed"`
+	IP      string `json:"ip,omitempty"`
+	Resolve int    `json:"resolve"`
+	Connect int    `json:"connect"`
+	TLS     int    `json:"tls,omitempty"`
+	// CertExpiry 服务器证书到期时间，REALITY 节点为伪装站点的证书
+	CertExpiry  *time.Time `json:"certExpiry,omitempty"`
+	CertExpired bool       `json:"certExpired,omitempty"`
+	SNIMismatch bool       `json:"sniMismatch,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	ErrorClass  string     `json:"errorClass,omitempty"`
+}
+
+// PrescreenAll 检查 results 中下标为 pending 的节点，不通过的节点记录错误，返回通过的下标
+func (app *XrayApp) PrescreenAll(ctx context.Context, results []NodeResult, pending []int) []int {
+	config := app.config.Test.Prescreen
+	screened := make([]PrescreenResult, len(pending))
+	app.runTests(ctx, "prescreen", len(pending), config.Concurrency, func(ctx context.Context, j int) {
+		screened[j] = app.Prescreen(ctx, results[pending[j]].Node)
+	})
+
+	var passed []int
+	var report []PrescreenResult
+	for j, p := range screened {
+		i := pending[j]
+		if p.Key == "" {
+			// 整轮测试被取消或超时，没有检查
+			continue
+		}
+		report = append(report, p)
+		if p.Passed {
+			passed = append(passed, i)
+			continue
+		}
+		log.Infof("prescreen failed, %v: %v", results[i].Node.Ps, p.Error)
+		results[i].Error = p.Error
+		results[i].ErrorClass = p.ErrorClass
+	}
+	app.prescreenMu.Lock()
+	app.prescreen = report
+	app.prescreenMu.Unlock()
+	log.Infof("prescreen complete, %v/%v passed", len(passed), len(pending))
+	return passed
+}
+
+// Prescreen 解析节点地址并直接连接，tls/xtls/reality 节点完成 TLS 握手；
+// 证书过期或与 SNI 不匹配且节点未设置 allowInsecure 时不通过
+func (app *XrayApp) Prescreen(ctx context.Context, v *V2Ray) PrescreenResult {
+	r := PrescreenResult{Key: v.Key(), Tag: v.GetTag("proxy_")}
+	fail := func(err error, class string) PrescreenResult {
+		r.Error = err.Error()
+		r.ErrorClass = class
+		if class == "" {
+			r.ErrorClass = classifyError(err)
+		}
+		return r
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(app.config.Test.Prescreen.Timeout)*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, v.Add)
+	if err != nil {
+		return fail(err, ErrClassDns)
+	}
+	if len(addrs) == 0 {
+		return fail(fmt.Errorf("no address for %v", v.Add), ErrClassDns)
+	}
+	r.Resolve = int(time.Since(start).Milliseconds())
+	r.IP = addrs[0].IP.String()
+
+	// 基于 UDP 的传输方式无法直接检查
+	switch strings.ToLower(v.Net) {
+	case "kcp", "mkcp", "quic":
+		r.Passed = true
+		return r
+	}
+
+	start = time.Now()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(r.IP, strconv.Itoa(v.Port)))
+	if err != nil {
+		return fail(err, "")
+	}
+	defer conn.Close()
+	r.Connect = int(time.Since(start).Milliseconds())
+
+	security := strings.ToLower(v.TLS)
+	if security != "tls" && security != "xtls" && security != "reality" {
+		r.Passed = true
+		return r
+	}
+	sni := v.SNI
+	if sni == "" && security != "reality" {
+		sni = v.Host
+	}
+	if sni == "" {
+		sni = v.Add
+	}
+	start = time.Now()
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: sni, InsecureSkipVerify: true})
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		return fail(fmt.Errorf("tls handshake: %w", err), ErrClassTLS)
+	}
+	r.TLS = int(time.Since(start).Milliseconds())
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fail(errors.New("tls: no peer certificate"), ErrClassTLS)
+	}
+	cert := certs[0]
+	r.CertExpiry = &cert.NotAfter
+	// REALITY 握手得到的是伪装站点的证书，不影响节点可用性
+	if security == "reality" {
+		r.Passed = true
+		return r
+	}
+	r.CertExpired = time.Now().After(cert.NotAfter)
+	r.SNIMismatch = cert.VerifyHostname(sni) != nil
+	if !v.AllowInsecure {
+		if r.CertExpired {
+			return fail(fmt.Errorf("tls: certificate expired at %v", cert.NotAfter.Format(time.DateOnly)), ErrClassTLS)
+		}
+		if r.SNIMismatch {
+			return fail(fmt.Errorf("tls: certificate is not valid for %v", sni), ErrClassTLS)
+		}
+	}
+	r.Passed = true
+	return r
+}
+
+func (app *XrayApp) PrescreenReport() []PrescreenResult {
+	app.prescreenMu.Lock()
+	defer app.prescreenMu.Unlock()
+	return app.prescreen
+}
@@ -0,0 +1,111 @@
+package xray
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/golang/glog"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+	"xray-helper/common"
+)
+
+// 读取响应体的上限，只用于 bodyContains 匹配
+const maxProbeBodySize = 1 << 20
+
+// probe 通过 client 请求一个测试目标，返回耗时(毫秒)
+func probe(ctx context.Context, client *http.Client, p common.ProbeConfig) (int, error) {
+	request, err := http.NewRequestWithContext(ctx, p.Method, p.Url, nil)
+	if err != nil {
+		return -1, err
+	}
+
+	start := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		return -1, err
+	}
+	defer response.Body.Close()
+
+	if !statusExpected(p.ExpectStatus, response.StatusCode) {
+		return -1, fmt.Errorf("unexpected status %v", response.StatusCode)
+	}
+	if p.BodyContains != "" || p.BodyNotContains != "" {
+		body, err := io.ReadAll(io.LimitReader(response.Body, maxProbeBodySize))
+		if err != nil {
+			return -1, err
+		}
+		if p.BodyContains != "" && !bytes.Contains(body, []byte(p.BodyContains)) {
+			return -1, fmt.Errorf("body does not contain '%v'", p.BodyContains)
+		}
+		if p.BodyNotContains != "" && bytes.Contains(body, []byte(p.BodyNotContains)) {
+			return -1, fmt.Errorf("body contains '%v'", p.BodyNotContains)
+		}
+	} else {
+		io.Copy(io.Discard, io.LimitReader(response.Body, maxProbeBodySize))
+	}
+	return int(time.Since(start).Milliseconds()), nil
+}
+
+func statusExpected(expect []int, status int) bool {
+	if len(expect) == 0 {
+		return status >= 200 && status < 400
+	}
+	for _, s := range expect {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// probeAll 依次请求所有测试目标，返回成功目标的加权平均耗时；
+// 成功目标权重不足一半时视为失败，返回 -1 及最后一个错误
+func probeAll(ctx context.Context, client *http.Client, probes []common.ProbeConfig, timeout time.Duration, name string) (int, error) {
+	var totalWeight, okWeight, weightedCost int
+	var lastErr error
+	for _, p := range probes {
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		totalWeight += p.Weight
+		probeCtx, cancel := context.WithTimeout(ctx, timeout)
+		cost, err := probe(probeCtx, client, p)
+		cancel()
+		if err != nil {
+			log.Errorf("test failed: %s probe '%s' %v", name, p.Url, err)
+			lastErr = err
+			continue
+		}
+		okWeight += p.Weight
+		weightedCost += cost * p.Weight
+	}
+	if okWeight == 0 || okWeight*2 < totalWeight {
+		if lastErr == nil {
+			lastErr = errors.New("not enough probes succeeded")
+		}
+		return -1, lastErr
+	}
+	return weightedCost / okWeight, nil
+}
+
+func newProxyClient(proxyUrlStr string) (*http.Client, error) {
+	proxyUrl, err := url.Parse(proxyUrlStr)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyURL(proxyUrl),
+	}
+	client := &http.Client{
+		Transport: transport,
+		// 测试目标的重定向不跟随，按首个响应判断
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return client, nil
+}
@@ -0,0 +1,118 @@
+package xray
+
+import (
+	log "github.com/golang/glog"
+	"sort"
+	"time"
+	"xray-helper/common"
+)
+
+// Quarantine 节点隔离状态，Failures 为连续失败轮数，Count 为连续隔离次数，
+// Probation 为隔离结束后的试测
+type Quarantine struct {
+	Failures  int       `json:"failures"`
+	Count     int       `json:"count"`
+	Until     time.Time `json:"until,omitempty"`
+	Probation bool      `json:"probation,omitempty"`
+}
+
+// QuarantineEntry 隔离中或试测中的节点
+type QuarantineEntry struct {
+	Key string `json:"key"`
+	Tag string `json:"tag"`
+	Quarantine
+}
+
+// Admit 节点本轮是否参与测试，隔离到期的节点转为试测
+func (h *HistoryStore) Admit(key string, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n, ok := h.Nodes[key]
+	if !ok || n.Quarantine.Until.IsZero() {
+		return true
+	}
+	if now.Before(n.Quarantine.Until) {
+		return false
+	}
+	n.Quarantine.Until = time.Time{}
+	n.Quarantine.Probation = true
+	return true
+}
+
+// UpdateQuarantine 按本轮结果更新隔离状态，应在 Record 之后调用
+func (h *HistoryStore) UpdateQuarantine(results []NodeResult, config common.QuarantineConfig, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range results {
+		if r.ErrorClass == ErrClassNotTested || r.ErrorClass == ErrClassQuarantined {
+			continue
+		}
+		n, ok := h.Nodes[r.Node.Key()]
+		if !ok {
+			continue
+		}
+		q := &n.Quarantine
+		if r.Available() {
+			if q.Probation {
+				log.Infof("node passed probation, %v", r.Node.Ps)
+			}
+			*q = Quarantine{}
+			continue
+		}
+		q.Failures++
+		if !q.Probation && q.Failures < config.Failures {
+			continue
+		}
+		q.Count++
+		d := time.Duration(config.Duration) * time.Second << min(q.Count-1, 16)
+		if maxDuration := time.Duration(config.MaxDuration) * time.Second; d > maxDuration {
+			d = maxDuration
+		}
+		q.Until = now.Add(d)
+		q.Failures = 0
+		q.Probation = false
+		log.Infof("node quarantined until %v, %v", q.Until.Format(time.DateTime), r.Node.Ps)
+	}
+}
+
+// Quarantined 隔离中或试测中的节点，按隔离结束时间排序
+func (h *HistoryStore) Quarantined() []QuarantineEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var list []QuarantineEntry
+	for _, n := range h.Nodes {
+		if n.Quarantine.Until.IsZero() && !n.Quarantine.Probation {
+			continue
+		}
+		list = append(list, QuarantineEntry{Key: n.Key, Tag: n.Tag, Quarantine: n.Quarantine})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Until.Before(list[j].Until)
+	})
+	return list
+}
+
+// withoutQuarantined 去掉隔离中的节点，全部被隔离或读取历史失败时返回 v2rays
+func (app *XrayApp) withoutQuarantined(v2rays []*V2Ray) []*V2Ray {
+	if !app.config.Test.Quarantine.Enabled {
+		return v2rays
+	}
+	history, err := app.History()
+	if err != nil {
+		log.Errorf("load test history failed %v", err)
+		return v2rays
+	}
+	now := time.Now()
+	var admitted []*V2Ray
+	for _, v := range v2rays {
+		n, ok := history.Get(v.Key())
+		if ok && now.Before(n.Quarantine.Until) {
+			continue
+		}
+		admitted = append(admitted, v)
+	}
+	if len(admitted) == 0 {
+		return v2rays
+	}
+	return admitted
+}
@@ -0,0 +1,134 @@
+package xray
+
+import (
+	"testing"
+	"time"
+	"xray-helper/common"
+)
+
+func TestUpdateQuarantine(t *testing.T) {
+	config := common.QuarantineConfig{Enabled: true, Failures: 2, Duration: 60, MaxDuration: 150}
+	historyConfig := common.HistoryConfig{Alpha: 0.3, MaxRecords: 10}
+	a := testNode("a")
+	tests := []struct {
+		name string
+		// rounds 每轮结果，true 为可用，false 为失败
+		rounds   []bool
+		before   Quarantine
+		failures int
+		count    int
+		until    time.Duration
+	}{
+		{"one failure", []bool{false}, Quarantine{}, 1, 0, 0},
+		{"quarantined after failures", []bool{false, false}, Quarantine{}, 0, 1, 60 * time.Second},
+		{"success resets", []bool{false, true}, Quarantine{}, 0, 0, 0},
+		{"probation failure doubles", []bool{false}, Quarantine{Count: 1, Probation: true}, 0, 2, 120 * time.Second},
+		{"capped at max duration", []bool{false}, Quarantine{Count: 2, Probation: true}, 0, 3, 150 * time.Second},
+		{"probation passed", []bool{true}, Quarantine{Count: 2, Probation: true}, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHistory()
+			now := time.Now()
+			h.Record([]NodeResult{passed(a, 100)}, historyConfig, now)
+			h.Nodes[a.Key()].Quarantine = tt.before
+			for _, ok := range tt.rounds {
+				r := failed(a)
+				if ok {
+					r = passed(a, 100)
+				}
+				h.UpdateQuarantine([]NodeResult{r}, config, now)
+			}
+			q := h.Nodes[a.Key()].Quarantine
+			var until time.Time
+			if tt.until > 0 {
+				until = now.Add(tt.until)
+			}
+			if q.Failures != tt.failures || q.Count != tt.count || !q.Until.Equal(until) || q.Probation {
+				t.Errorf("quarantine %+v, want failures %v count %v until +%v", q, tt.failures, tt.count, tt.until)
+			}
+		})
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	a := testNode("a")
+	now := time.Now()
+	tests := []struct {
+		name      string
+		until     time.Time
+		admit     bool
+		probation bool
+	}{
+		{"not quarantined", time.Time{}, true, false},
+		{"quarantined", now.Add(time.Minute), false, false},
+		{"quarantine ended", now.Add(-time.Minute), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHistory()
+			h.Nodes[a.Key()] = &NodeHistory{Key: a.Key(), Quarantine: Quarantine{Until: tt.until}}
+			if got := h.Admit(a.Key(), now); got != tt.admit {
+				t.Errorf("Admit() = %v, want %v", got, tt.admit)
+			}
+			if got := h.Nodes[a.Key()].Quarantine.Probation; got != tt.probation {
+				t.Errorf("Probation = %v, want %v", got, tt.probation)
+			}
+		})
+	}
+}
+
+// 本地网络中断时所有节点都失败，不应记录失败或隔离节点
+func TestRecordHistoryAllFailed(t *testing.T) {
+	var config common.XrayConfig
+	config.DataDir = t.TempDir()
+	config.Test.History = common.HistoryConfig{Alpha: 0.3, MaxRecords: 10}
+	config.Test.Quarantine = common.QuarantineConfig{Enabled: true, Failures: 3, Duration: 60, MaxDuration: 600}
+	app := &XrayApp{config: config}
+
+	var nodes []*V2Ray
+	var results []NodeResult
+	for _, ps := range []string{"a", "b", "c", "d"} {
+		v := testNode(ps)
+		nodes = append(nodes, v)
+		results = append(results, passed(v, 100))
+	}
+	history, err := app.recordHistory(results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 3; round++ {
+		results = results[:0]
+		for _, v := range nodes {
+			results = append(results, failed(v))
+		}
+		_, err = app.recordHistory(results)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q := history.Quarantined(); len(q) != 0 {
+		t.Errorf("%v nodes quarantined after rounds where no node passed", len(q))
+	}
+	for _, v := range nodes {
+		n, _ := history.Get(v.Key())
+		if n.SuccessRate != 1 || len(n.Records) != 1 {
+			t.Errorf("%v: success rate %v records %v, failures recorded", v.Ps, n.SuccessRate, len(n.Records))
+		}
+	}
+
+	// 部分节点可用时照常记录失败并隔离
+	for round := 0; round < 3; round++ {
+		results = []NodeResult{passed(nodes[0], 100)}
+		for _, v := range nodes[1:] {
+			results = append(results, failed(v))
+		}
+		_, err = app.recordHistory(results)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q := history.Quarantined(); len(q) != len(nodes)-1 {
+		t.Errorf("%v nodes quarantined, want %v", len(q), len(nodes)-1)
+	}
+}
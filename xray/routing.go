@@ -0,0 +1,225 @@
+package xray
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/golang/glog"
+	"github.com/xtls/xray-core/app/router"
+	routercmd "github.com/xtls/xray-core/app/router/command"
+	xnet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/infra/conf"
+	"net"
+	"strings"
+	"xray-helper/common"
+)
+
+var ErrInvalidRouting = errors.New("invalid routing config")
+
+// BalancerInfo 负载均衡当前状态，Override 为手动固定的出站
+type BalancerInfo struct {
+	Tag      string   `json:"tag"`
+	Override string   `json:"override,omitempty"`
+	Targets  []string `json:"targets"`
+}
+
+// RouteResult 路由测试结果
+type RouteResult struct {
+	OutboundTag       string   `json:"outboundTag"`
+	OutboundGroupTags []string `json:"outboundGroupTags,omitempty"`
+}
+
+// buildRouting 将当前路由配置转换为 RoutingService 使用的 protobuf，
+// geosite/geoip 从 xrayAssetDir 读取
+func (app *XrayApp) buildRouting() (*router.Config, error) {
+	data, err := app.routeConfig()
+	if err != nil {
+		return nil, err
+	}
+	var m struct {
+		Routing conf.RouterConfig `json:"routing"`
+	}
+	err = json.Unmarshal([]byte(data), &m)
+	if err != nil {
+		return nil, err
+	}
+	return m.Routing.Build()
+}
+
+// ReloadRouting 重新生成路由配置文件并替换正在运行的 xray 中的全部规则与负载均衡，
+// 替换后恢复通过 /routing/balancer 固定的出站；配置无效时不写入文件，api 失败时重启 xray
+func (app *XrayApp) ReloadRouting(ctx context.Context) error {
+	config, err := app.buildRouting()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRouting, err)
+	}
+	err = app.InitRouteConfig()
+	if err != nil {
+		return err
+	}
+	err = app.applyRouting(ctx, config)
+	if err != nil {
+		log.Errorf("apply routing through api failed, restarting: %v", err)
+		return app.Restart(false)
+	}
+	app.reapplyOverrides(ctx)
+	return nil
+}
+
+func (app *XrayApp) applyRouting(ctx context.Context, config *router.Config) error {
+	client, err := app.Grpc()
+	if err != nil {
+		return err
+	}
+	return client.AddRule(ctx, config, false)
+}
+
+// UpdateDomainList 修改直连(whitelist)或代理(blacklist)域名列表并实时生效，仅在内存中保存
+func (app *XrayApp) UpdateDomainList(ctx context.Context, whitelist bool, add []string, remove []string) ([]string, error) {
+	app.domainMu.Lock()
+	defer app.domainMu.Unlock()
+	list := func(config *common.XrayConfig) *[]string {
+		if whitelist {
+			return &config.DomainWhitelist
+		}
+		return &config.DomainBlacklist
+	}
+	removed := make(map[string]bool)
+	for _, d := range remove {
+		removed[strings.TrimSpace(d)] = true
+	}
+	var old, result []string
+	app.updateConfig(func(config *common.XrayConfig) {
+		old = *list(config)
+		exists := make(map[string]bool)
+		for _, d := range append(append([]string{}, old...), add...) {
+			d = strings.TrimSpace(d)
+			if d == "" || removed[d] || exists[d] {
+				continue
+			}
+			exists[d] = true
+			result = append(result, d)
+		}
+		*list(config) = result
+	})
+	err := app.ReloadRouting(ctx)
+	if errors.Is(err, ErrInvalidRouting) {
+		app.updateConfig(func(config *common.XrayConfig) {
+			*list(config) = old
+		})
+	}
+	return result, err
+}
+
+func (app *XrayApp) DomainList(whitelist bool) []string {
+	config := app.configSnapshot()
+	if whitelist {
+		return config.DomainWhitelist
+	}
+	return config.DomainBlacklist
+}
+
+// TestRoute 查询 xray 对目标的路由结果，target 为域名或 ip
+func (app *XrayApp) TestRoute(ctx context.Context, inboundTag string, network string, target string, port uint32) (RouteResult, error) {
+	var result RouteResult
+	client, err := app.Grpc()
+	if err != nil {
+		return result, err
+	}
+	rc := &routercmd.RoutingContext{
+		InboundTag: inboundTag,
+		Network:    xnet.Network_TCP,
+		TargetPort: port,
+	}
+	if strings.ToLower(network) == "udp" {
+		rc.Network = xnet.Network_UDP
+	}
+	if ip := net.ParseIP(target); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		rc.TargetIPs = [][]byte{ip}
+	} else {
+		rc.TargetDomain = target
+	}
+	resp, err := client.TestRoute(ctx, rc)
+	if err != nil {
+		return result, err
+	}
+	result.OutboundTag = resp.GetOutboundTag()
+	result.OutboundGroupTags = resp.GetOutboundGroupTags()
+	return result, nil
+}
+
+func (app *XrayApp) BalancerInfo(ctx context.Context, tag string) (BalancerInfo, error) {
+	info := BalancerInfo{Tag: tag}
+	client, err := app.Grpc()
+	if err != nil {
+		return info, err
+	}
+	msg, err := client.GetBalancerInfo(ctx, tag)
+	if err != nil {
+		return info, err
+	}
+	if msg == nil {
+		return info, errors.New("balancer not found")
+	}
+	info.Override = msg.GetOverride().GetTarget()
+	info.Targets = msg.GetPrincipleTarget().GetTag()
+	return info, nil
+}
+
+// OverrideBalancer 固定负载均衡的出站并记录，target 为空时取消
+func (app *XrayApp) OverrideBalancer(ctx context.Context, tag string, target string) error {
+	client, err := app.Grpc()
+	if err != nil {
+		return err
+	}
+	err = client.OverrideBalancerTarget(ctx, tag, target)
+	if err != nil {
+		return err
+	}
+	app.overrideMu.Lock()
+	defer app.overrideMu.Unlock()
+	if target == "" {
+		delete(app.overrides, tag)
+		return nil
+	}
+	if app.overrides == nil {
+		app.overrides = make(map[string]string)
+	}
+	app.overrides[tag] = target
+	return nil
+}
+
+// reapplyOverrides 替换路由后重新固定记录的出站，负载均衡已不存在时取消记录
+func (app *XrayApp) reapplyOverrides(ctx context.Context) {
+	app.overrideMu.Lock()
+	defer app.overrideMu.Unlock()
+	if len(app.overrides) == 0 {
+		return
+	}
+	client, err := app.Grpc()
+	if err != nil {
+		log.Errorf("reapply balancer overrides failed %v", err)
+		return
+	}
+	for tag, target := range app.overrides {
+		err := client.OverrideBalancerTarget(ctx, tag, target)
+		if err != nil {
+			log.Errorf("reapply balancer override failed, reset %v: %v", tag, err)
+			delete(app.overrides, tag)
+		}
+	}
+}
+
+// resetOverrides 新启动的 xray 没有固定的出站
+func (app *XrayApp) resetOverrides() {
+	app.overrideMu.Lock()
+	defer app.overrideMu.Unlock()
+	if len(app.overrides) > 0 {
+		log.Warningf("xray restarted, balancer overrides reset: %v", app.overrides)
+	}
+	app.overrides = make(map[string]string)
+}
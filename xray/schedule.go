@@ -0,0 +1,120 @@
+package xray
+
+import (
+	"errors"
+	log "github.com/golang/glog"
+	"github.com/robfig/cron/v3"
+	"math/rand"
+	"time"
+	"xray-helper/common"
+)
+
+// ScheduleStatus 下次定时测试时间及最近一次测试(含手动触发)的结果
+type ScheduleStatus struct {
+	Next              time.Time `json:"next,omitempty"`
+	LastRun           time.Time `json:"lastRun,omitempty"`
+	LastDurationMs    int64     `json:"lastDurationMs"`
+	LastOk            bool      `json:"lastOk"`
+	LastError         string    `json:"lastError,omitempty"`
+	ConsecutiveErrors int       `json:"consecutiveErrors"`
+}
+
+// TimeTest 按 schedule 在后台定时测试，出错后按 retryInterval 退避重试
+func (app *XrayApp) TimeTest() {
+	go func() {
+		for {
+			next := app.nextRun(time.Now(), app.ScheduleStatus().ConsecutiveErrors)
+			app.scheduleMu.Lock()
+			app.schedule.Next = next
+			app.scheduleMu.Unlock()
+			log.Infof("next scheduled test at %v", next.Format(time.DateTime))
+
+			time.Sleep(time.Until(next))
+			log.Info("TimedTest executing...")
+			err := app.TestAll()
+			if errors.Is(err, ErrTestRunning) {
+				log.Info("test already running, skip scheduled test")
+				continue
+			}
+			if err != nil {
+				log.Errorf("scheduled test failed %v", err)
+			}
+		}
+	}()
+}
+
+// nextRun 计算下一次定时测试的时间，errCount 为连续出错次数
+func (app *XrayApp) nextRun(now time.Time, errCount int) time.Time {
+	sc := app.config.Schedule
+	var next time.Time
+	if sc.Cron != "" {
+		schedule, _ := cron.ParseStandard(sc.Cron)
+		next = schedule.Next(now)
+	} else {
+		d := time.Duration(sc.Interval) * time.Second
+		if sc.Jitter > 0 {
+			d += time.Duration(rand.Int63n(int64(sc.Jitter)+1)) * time.Second
+		}
+		next = now.Add(d)
+	}
+	if errCount > 0 {
+		retry := time.Duration(sc.RetryInterval) * time.Second << min(errCount-1, 16)
+		if now.Add(retry).Before(next) {
+			next = now.Add(retry)
+		}
+	}
+	return afterQuietHours(next, sc.QuietHours)
+}
+
+// afterQuietHours t 落在静默时间段内时顺延到该时间段结束
+func afterQuietHours(t time.Time, quietHours []string) time.Time {
+	for i := 0; i <= len(quietHours); i++ {
+		moved := false
+		for _, q := range quietHours {
+			start, end, err := common.ParseQuietHours(q)
+			if err != nil || start == end {
+				continue
+			}
+			m := t.Hour()*60 + t.Minute()
+			in := start <= m && m < end
+			if start > end {
+				in = m >= start || m < end
+			}
+			if !in {
+				continue
+			}
+			endTime := time.Date(t.Year(), t.Month(), t.Day(), end/60, end%60, 0, 0, t.Location())
+			if !endTime.After(t) {
+				endTime = endTime.AddDate(0, 0, 1)
+			}
+			t = endTime
+			moved = true
+		}
+		if !moved {
+			break
+		}
+	}
+	return t
+}
+
+func (app *XrayApp) recordTestOutcome(start time.Time, err error) {
+	app.scheduleMu.Lock()
+	defer app.scheduleMu.Unlock()
+	s := &app.schedule
+	s.LastRun = start
+	s.LastDurationMs = time.Since(start).Milliseconds()
+	s.LastOk = err == nil
+	s.LastError = ""
+	if err != nil {
+		s.LastError = err.Error()
+		s.ConsecutiveErrors++
+	} else {
+		s.ConsecutiveErrors = 0
+	}
+}
+
+func (app *XrayApp) ScheduleStatus() ScheduleStatus {
+	app.scheduleMu.Lock()
+	defer app.scheduleMu.Unlock()
+	return app.schedule
+}
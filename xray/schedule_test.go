@@ -0,0 +1,37 @@
+package xray
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAfterQuietHours(t *testing.T) {
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name  string
+		t     time.Time
+		quiet []string
+		want  time.Time
+	}{
+		{"no quiet hours", at(1, 3, 0), nil, at(1, 3, 0)},
+		{"outside", at(1, 8, 0), []string{"02:00-06:00"}, at(1, 8, 0)},
+		{"inside", at(1, 3, 30), []string{"02:00-06:00"}, at(1, 6, 0)},
+		{"at start", at(1, 2, 0), []string{"02:00-06:00"}, at(1, 6, 0)},
+		{"at end", at(1, 6, 0), []string{"02:00-06:00"}, at(1, 6, 0)},
+		{"across midnight before", at(1, 23, 30), []string{"23:00-07:00"}, at(2, 7, 0)},
+		{"across midnight after", at(2, 1, 0), []string{"23:00-07:00"}, at(2, 7, 0)},
+		{"chained ranges", at(1, 3, 0), []string{"02:00-04:00", "04:00-05:00"}, at(1, 5, 0)},
+		{"chained ranges reverse order", at(1, 3, 0), []string{"04:00-05:00", "02:00-04:00"}, at(1, 5, 0)},
+		{"invalid ignored", at(1, 3, 0), []string{"bad"}, at(1, 3, 0)},
+		{"empty range ignored", at(1, 3, 0), []string{"03:00-03:00"}, at(1, 3, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := afterQuietHours(tt.t, tt.quiet); !got.Equal(tt.want) {
+				t.Errorf("afterQuietHours(%v, %v) = %v, want %v", tt.t, tt.quiet, got, tt.want)
+			}
+		})
+	}
+}
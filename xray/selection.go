@@ -0,0 +1,207 @@
+package xray
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"xray-helper/common"
+)
+
+// SelectionEntry 一个节点在本轮选择中的结果
+type SelectionEntry struct {
+	Key          string `json:"key"`
+	Tag          string `json:"tag"`
+	Subscription string `json:"subscription"`
+	Region       string `json:"region,omitempty"`
+	// ExitCountry 实际出口所在国家，可能与备注不同
+	ExitCountry string  `json:"exitCountry,omitempty"`
+	Score       float64 `json:"score"`
+	Selected    bool    `json:"selected"`
+	Reason      string  `json:"reason"`
+}
+
+// SelectionReport 最近一次选择的策略与结果
+type SelectionReport struct {
+	Policy  common.SelectionConfig `json:"policy"`
+	Entries []SelectionEntry       `json:"entries"`
+}
+
+// selectNodes 按选择策略从已按评分排序的可用节点中选出写入 proxy-balancer 的节点
+func (app *XrayApp) selectNodes(ranked []NodeResult, history *HistoryStore) ([]*V2Ray, []SelectionEntry) {
+	policy := app.config.Selection
+	testConfig := app.config.Test
+	entries := make([]SelectionEntry, len(ranked))
+	var selected []*V2Ray
+	subCount := make(map[string]int)
+	regionCount := make(map[string]int)
+	pick := func(i int, reason string) {
+		v := ranked[i].Node
+		entries[i].Selected = true
+		entries[i].Reason = reason
+		selected = append(selected, v)
+		subCount[v.Subscription]++
+		regionCount[entries[i].Region]++
+	}
+
+	for i, r := range ranked {
+		h, _ := history.Get(r.Node.Key())
+		entries[i] = SelectionEntry{
+			Key:          r.Node.Key(),
+			Tag:          r.Tag,
+			Subscription: r.Node.Subscription,
+			Region:       app.Region(r.Node),
+			Score:        h.EffectiveScore(testConfig.Score),
+		}
+		if h.Exit != nil {
+			entries[i].ExitCountry = h.Exit.Country
+		}
+	}
+
+	// 固定的节点本轮可用时只选择固定的节点，都不可用时取消固定
+	nodes := make([]*V2Ray, len(ranked))
+	for i, r := range ranked {
+		nodes[i] = r.Node
+	}
+	if pinned := app.pinnedNodes(nodes, true); len(pinned) > 0 {
+		for i, r := range ranked {
+			if slices.Contains(pinned, r.Node) {
+				pick(i, "pinned")
+			} else {
+				entries[i].Reason = "not pinned"
+			}
+		}
+		return selected, entries
+	}
+
+	// 总是选择的节点不受数量与条件限制
+	for i, r := range ranked {
+		if matchNode(policy.NeverInclude, r.Node) {
+			entries[i].Reason = "never include"
+			continue
+		}
+		if matchNode(policy.AlwaysInclude, r.Node) {
+			pick(i, "always include")
+		}
+	}
+
+	// 当前已选节点的评分按 margin 打折后参与排序，其他节点须明显更优才能替换它
+	current := make(map[string]bool)
+	for _, v := range app.Selected {
+		current[v.Key()] = true
+	}
+	adjusted := func(i int) float64 {
+		if current[entries[i].Key] {
+			return entries[i].Score * (1 - policy.Margin)
+		}
+		return entries[i].Score
+	}
+	order := make([]int, len(ranked))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return adjusted(order[a]) < adjusted(order[b])
+	})
+
+	for _, i := range order {
+		r := ranked[i]
+		if entries[i].Reason != "" {
+			continue
+		}
+		if len(selected) >= policy.TopN {
+			entries[i].Reason = "top n reached"
+			continue
+		}
+		if reason := app.ineligible(r, history); reason != "" {
+			entries[i].Reason = reason
+			continue
+		}
+		if q, ok := policy.SubscriptionQuota[r.Node.Subscription]; ok && subCount[r.Node.Subscription] >= q {
+			entries[i].Reason = "subscription quota reached"
+			continue
+		}
+		region := entries[i].Region
+		if q, ok := policy.RegionQuota[region]; ok && regionCount[region] >= q {
+			entries[i].Reason = "region quota reached"
+			continue
+		}
+		if current[entries[i].Key] && r.ErrorClass == ErrClassNotTested {
+			pick(i, "ranked, current, not tested")
+			continue
+		}
+		if current[entries[i].Key] {
+			pick(i, "ranked, current")
+			continue
+		}
+		pick(i, "ranked")
+	}
+
+	// 不足最小数量时用其余节点按评分补足，宁可慢也不让 balancer 为空
+	for i, r := range ranked {
+		if len(selected) >= policy.MinPoolSize {
+			break
+		}
+		if entries[i].Selected || matchNode(policy.NeverInclude, r.Node) {
+			continue
+		}
+		pick(i, "min pool size fallback, "+entries[i].Reason)
+	}
+	return selected, entries
+}
+
+// ineligible 节点不满足选择条件的原因，满足时返回空
+func (app *XrayApp) ineligible(r NodeResult, history *HistoryStore) string {
+	policy := app.config.Selection
+	testConfig := app.config.Test
+	h, _ := history.Get(r.Node.Key())
+	if h.SuccessRate < testConfig.History.MinSuccessRate {
+		return fmt.Sprintf("success rate %.2f below %.2f", h.SuccessRate, testConfig.History.MinSuccessRate)
+	}
+	if policy.MaxLatency > 0 && r.Latency.Median > policy.MaxLatency {
+		return fmt.Sprintf("latency %vms above %vms", r.Latency.Median, policy.MaxLatency)
+	}
+	if testConfig.Udp.Enabled && testConfig.Udp.Require && !r.Node.UDP {
+		return "udp not supported"
+	}
+	// 本轮没有测试的当前节点及带宽测试未完成的节点没有带宽结果，不按带宽排除
+	if minMbps := testConfig.Throughput.MinMbps; testConfig.Throughput.Enabled && minMbps > 0 && r.ErrorClass != ErrClassNotTested {
+		t := r.Throughput
+		if t == nil || !t.NotTested && (t.Error != "" || t.Mbps < minMbps) {
+			return fmt.Sprintf("throughput below %vMbps", minMbps)
+		}
+	}
+	return ""
+}
+
+// Region 按 selection.regions 匹配节点备注得到的地区，未匹配时为空
+func (app *XrayApp) Region(v *V2Ray) string {
+	for _, r := range app.config.Selection.Regions {
+		if matched, _ := regexp.MatchString(r.Pattern, v.Ps); matched {
+			return r.Name
+		}
+	}
+	return ""
+}
+
+// matchNode 节点 key 等于或备注匹配任一模式
+func matchNode(patterns []string, v *V2Ray) bool {
+	for _, p := range patterns {
+		if p == v.Key() {
+			return true
+		}
+		if matched, _ := regexp.MatchString(p, v.Ps); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *XrayApp) SelectionReport() SelectionReport {
+	app.selectionMu.Lock()
+	defer app.selectionMu.Unlock()
+	return SelectionReport{
+		Policy:  app.config.Selection,
+		Entries: app.selection,
+	}
+}
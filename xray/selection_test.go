@@ -0,0 +1,207 @@
+package xray
+
+import (
+	"slices"
+	"testing"
+	"xray-helper/common"
+)
+
+type selectionNode struct {
+	ps           string
+	subscription string
+	score        float64
+	successRate  float64
+	result       func(v *V2Ray) NodeResult
+}
+
+func ranked(ps string, score float64) selectionNode {
+	return selectionNode{ps: ps, score: score, successRate: 1}
+}
+
+func TestSelectNodes(t *testing.T) {
+	base := common.SelectionConfig{TopN: 2, MinPoolSize: 1}
+	withPolicy := func(update func(p *common.SelectionConfig)) common.SelectionConfig {
+		p := base
+		update(&p)
+		return p
+	}
+	tests := []struct {
+		name    string
+		policy  common.SelectionConfig
+		test    func(c *common.TestConfig)
+		nodes   []selectionNode
+		current []string
+		want    []string
+	}{
+		{
+			name:   "top n by score",
+			policy: base,
+			nodes:  []selectionNode{ranked("a", 100), ranked("b", 200), ranked("c", 300)},
+			want:   []string{"a", "b"},
+		},
+		{
+			name: "never and always include",
+			policy: withPolicy(func(p *common.SelectionConfig) {
+				p.NeverInclude = []string{"^a$"}
+				p.AlwaysInclude = []string{"^d$"}
+			}),
+			nodes: []selectionNode{ranked("a", 100), ranked("b", 200), ranked("c", 300), ranked("d", 400)},
+			want:  []string{"d", "b"},
+		},
+		{
+			name: "subscription quota",
+			policy: withPolicy(func(p *common.SelectionConfig) {
+				p.SubscriptionQuota = map[string]int{"main": 1}
+			}),
+			nodes: []selectionNode{
+				{ps: "a", subscription: "main", score: 100, successRate: 1},
+				{ps: "b", subscription: "main", score: 200, successRate: 1},
+				{ps: "c", subscription: "backup", score: 300, successRate: 1},
+			},
+			want: []string{"a", "c"},
+		},
+		{
+			name: "region quota",
+			policy: withPolicy(func(p *common.SelectionConfig) {
+				p.Regions = []common.RegionConfig{{Name: "hk", Pattern: "^hk"}}
+				p.RegionQuota = map[string]int{"hk": 1}
+			}),
+			nodes: []selectionNode{ranked("hk1", 100), ranked("hk2", 200), ranked("jp1", 300)},
+			want:  []string{"hk1", "jp1"},
+		},
+		{
+			name:    "current kept within margin",
+			policy:  withPolicy(func(p *common.SelectionConfig) { p.TopN = 1; p.Margin = 0.1 }),
+			nodes:   []selectionNode{ranked("a", 100), ranked("b", 105)},
+			current: []string{"b"},
+			want:    []string{"b"},
+		},
+		{
+			name:    "current replaced beyond margin",
+			policy:  withPolicy(func(p *common.SelectionConfig) { p.TopN = 1; p.Margin = 0.1 }),
+			nodes:   []selectionNode{ranked("a", 100), ranked("b", 120)},
+			current: []string{"b"},
+			want:    []string{"a"},
+		},
+		{
+			name:   "low success rate ineligible",
+			policy: base,
+			nodes: []selectionNode{
+				{ps: "a", score: 100, successRate: 0.2},
+				ranked("b", 200),
+				ranked("c", 300),
+			},
+			want: []string{"b", "c"},
+		},
+		{
+			name:   "min pool size fallback",
+			policy: withPolicy(func(p *common.SelectionConfig) { p.MaxLatency = 50; p.MinPoolSize = 2 }),
+			nodes:  []selectionNode{ranked("a", 100), ranked("b", 200), ranked("c", 300)},
+			want:   []string{"a", "b"},
+		},
+		{
+			name:   "throughput below minimum",
+			policy: base,
+			test: func(c *common.TestConfig) {
+				c.Throughput = common.ThroughputConfig{Enabled: true, MinMbps: 10}
+			},
+			nodes: []selectionNode{
+				{ps: "a", score: 100, successRate: 1, result: withThroughput(&ThroughputResult{Mbps: 5})},
+				{ps: "b", score: 200, successRate: 1, result: withThroughput(&ThroughputResult{Mbps: 20})},
+				{ps: "c", score: 300, successRate: 1, result: withThroughput(&ThroughputResult{Error: "not tested", NotTested: true})},
+				{ps: "d", score: 400, successRate: 1, result: withThroughput(nil)},
+			},
+			want: []string{"b", "c"},
+		},
+		{
+			name:   "untested current node kept",
+			policy: base,
+			nodes: []selectionNode{
+				{ps: "a", score: 300, successRate: 1, result: notTested},
+				ranked("b", 100),
+			},
+			current: []string{"a"},
+			want:    []string{"b", "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config common.XrayConfig
+			config.DataDir = t.TempDir()
+			config.Selection = tt.policy
+			config.Test.History.MinSuccessRate = 0.5
+			if tt.test != nil {
+				tt.test(&config.Test)
+			}
+			app := &XrayApp{config: config}
+			history := newTestHistory()
+			var results []NodeResult
+			byPs := make(map[string]*V2Ray)
+			for _, n := range tt.nodes {
+				v := testNode(n.ps)
+				v.Subscription = n.subscription
+				byPs[n.ps] = v
+				history.Nodes[v.Key()] = &NodeHistory{Key: v.Key(), Score: n.score, SuccessRate: n.successRate}
+				r := passed(v, int(n.score))
+				if n.result != nil {
+					r = n.result(v)
+				}
+				results = append(results, r)
+			}
+			for _, ps := range tt.current {
+				app.Selected = append(app.Selected, byPs[ps])
+			}
+
+			selected, entries := app.selectNodes(results, history)
+			var got []string
+			for _, v := range selected {
+				got = append(got, v.Ps)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("selected %v, want %v", got, tt.want)
+				for _, e := range entries {
+					t.Logf("%v: %v", e.Tag, e.Reason)
+				}
+			}
+		})
+	}
+}
+
+func withThroughput(tr *ThroughputResult) func(v *V2Ray) NodeResult {
+	return func(v *V2Ray) NodeResult {
+		r := passed(v, 100)
+		r.Throughput = tr
+		return r
+	}
+}
+
+func TestSelectNodesPinned(t *testing.T) {
+	var config common.XrayConfig
+	config.DataDir = t.TempDir()
+	config.Selection = common.SelectionConfig{TopN: 2, MinPoolSize: 1}
+	app := &XrayApp{config: config}
+	a, b, c := testNode("a"), testNode("b"), testNode("c")
+	history := newTestHistory()
+	for _, v := range []*V2Ray{a, b, c} {
+		history.Nodes[v.Key()] = &NodeHistory{Key: v.Key(), Score: 100, SuccessRate: 1}
+	}
+	meta, err := app.NodeMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta.SetPin(&Pin{Node: c.Key()})
+	selected, _ := app.selectNodes([]NodeResult{passed(a, 100), passed(b, 100), passed(c, 100)}, history)
+	if len(selected) != 1 || selected[0] != c {
+		t.Errorf("selected %v, want only the pinned node", selected)
+	}
+
+	// 固定的节点本轮不可用时取消固定，按策略选择
+	selected, _ = app.selectNodes([]NodeResult{passed(a, 100), passed(b, 100)}, history)
+	if len(selected) != 2 {
+		t.Errorf("selected %v nodes, want 2", len(selected))
+	}
+	if meta.GetPin() != nil {
+		t.Error("pin kept after pinned node became unavailable")
+	}
+}
@@ -0,0 +1,104 @@
+package xray
+
+import (
+	"context"
+	log "github.com/golang/glog"
+	"time"
+)
+
+// SiteResult 节点对一个站点的检查结果，Latency 单位为毫秒
+type SiteResult struct {
+	Ok      bool   `json:"ok"`
+	Latency int    `json:"latency,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// SiteMatrix 最近一轮站点检查的结果，Passed 为每个站点通过的节点数
+type SiteMatrix struct {
+	Time   time.Time      `json:"time"`
+	Sites  []string       `json:"sites"`
+	Passed map[string]int `json:"passed"`
+	Nodes  []SiteRow      `json:"nodes"`
+}
+
+type SiteRow struct {
+	Key     string                `json:"key"`
+	Tag     string                `json:"tag"`
+	Results map[string]SiteResult `json:"results"`
+}
+
+// TestSitesAll 对本轮可用的节点检查 test.sites，记录到 NodeResult.Sites 与 V2Ray.Sites
+func (app *XrayApp) TestSitesAll(ctx context.Context, inst *TestInstance, results []NodeResult) {
+	var available []int
+	for i, r := range results {
+		if r.Available() {
+			available = append(available, i)
+		}
+	}
+	app.runTests(ctx, "sites", len(available), app.config.Test.Concurrency, func(ctx context.Context, j int) {
+		i := available[j]
+		v := results[i].Node
+		sites := app.TestSites(ctx, inst, v)
+		if ctx.Err() != nil {
+			return
+		}
+		passed := make(map[string]bool)
+		for name, r := range sites {
+			passed[name] = r.Ok
+		}
+		log.Infof("site test complete, %v: %v", v.Ps, passed)
+		results[i].Sites = sites
+		v.Sites = passed
+	})
+
+	matrix := SiteMatrix{Time: time.Now(), Passed: make(map[string]int)}
+	for _, site := range app.config.Test.Sites {
+		matrix.Sites = append(matrix.Sites, site.Name)
+	}
+	for _, i := range available {
+		r := results[i]
+		if r.Sites == nil {
+			continue
+		}
+		matrix.Nodes = append(matrix.Nodes, SiteRow{Key: r.Node.Key(), Tag: r.Tag, Results: r.Sites})
+		for name, s := range r.Sites {
+			if s.Ok {
+				matrix.Passed[name]++
+			}
+		}
+	}
+	app.siteMu.Lock()
+	app.sites = matrix
+	app.siteMu.Unlock()
+}
+
+// TestSites 经由测试实例中的节点依次请求每个站点
+func (app *XrayApp) TestSites(ctx context.Context, inst *TestInstance, v *V2Ray) map[string]SiteResult {
+	sites := make(map[string]SiteResult)
+	client, err := testClient(inst, v)
+	if err != nil {
+		for _, site := range app.config.Test.Sites {
+			sites[site.Name] = SiteResult{Error: err.Error()}
+		}
+		return sites
+	}
+	defer client.CloseIdleConnections()
+	timeout := time.Duration(app.config.Test.ProbeTimeout) * time.Second
+	for _, site := range app.config.Test.Sites {
+		probeCtx, cancel := context.WithTimeout(ctx, timeout)
+		cost, err := probe(probeCtx, client, site.ProbeConfig)
+		cancel()
+		if err != nil {
+			sites[site.Name] = SiteResult{Error: err.Error()}
+			continue
+		}
+		sites[site.Name] = SiteResult{Ok: true, Latency: cost}
+	}
+	return sites
+}
+
+func (app *XrayApp) SiteMatrix() SiteMatrix {
+	app.siteMu.Lock()
+	defer app.siteMu.Unlock()
+	return app.sites
+}
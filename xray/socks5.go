@@ -0,0 +1,181 @@
+package xray
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// socks5Handshake 完成无认证的 socks5 协商并发送命令，返回服务端绑定的地址
+func socks5Handshake(conn net.Conn, cmd byte, target string) (string, error) {
+	_, err := conn.Write([]byte{5, 1, 0})
+	if err != nil {
+		return "", err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return "", err
+	}
+	if reply[0] != 5 || reply[1] != 0 {
+		return "", fmt.Errorf("socks5 auth method not accepted: %v", reply)
+	}
+
+	addr, err := socks5Addr(target)
+	if err != nil {
+		return "", err
+	}
+	_, err = conn.Write(append([]byte{5, cmd, 0}, addr...))
+	if err != nil {
+		return "", err
+	}
+	head := make([]byte, 3)
+	_, err = io.ReadFull(conn, head)
+	if err != nil {
+		return "", err
+	}
+	if head[1] != 0 {
+		return "", fmt.Errorf("socks5 command %v failed, reply code %v", cmd, head[1])
+	}
+	return readSocks5Addr(conn)
+}
+
+// socks5UDPExchange 通过 socks5 UDP ASSOCIATE 向 target 发送一个数据包并等待一个响应
+func socks5UDPExchange(ctx context.Context, proxyAddr string, target string, payload []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	relay, err := socks5Handshake(conn, 3, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	// 绑定地址为 0.0.0.0 时使用代理地址
+	relayHost, relayPort, err := net.SplitHostPort(relay)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(relayHost); ip == nil || ip.IsUnspecified() {
+		relayHost, _, _ = net.SplitHostPort(proxyAddr)
+	}
+
+	udpConn, err := d.DialContext(ctx, "udp", net.JoinHostPort(relayHost, relayPort))
+	if err != nil {
+		return nil, err
+	}
+	defer udpConn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		udpConn.SetDeadline(deadline)
+	}
+
+	addr, err := socks5Addr(target)
+	if err != nil {
+		return nil, err
+	}
+	packet := append([]byte{0, 0, 0}, addr...)
+	packet = append(packet, payload...)
+	_, err = udpConn.Write(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 64*1024)
+	n, err := udpConn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return stripSocks5UDPHeader(buf[:n])
+}
+
+func socks5Addr(target string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	var addr []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			addr = append([]byte{1}, ip4...)
+		} else {
+			addr = append([]byte{4}, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("socks5 host too long")
+		}
+		addr = append([]byte{3, byte(len(host))}, host...)
+	}
+	return binary.BigEndian.AppendUint16(addr, uint16(port)), nil
+}
+
+func readSocks5Addr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	_, err := io.ReadFull(r, atyp)
+	if err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case 1, 4:
+		size := net.IPv4len
+		if atyp[0] == 4 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		_, err = io.ReadFull(r, ip)
+		if err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		l := make([]byte, 1)
+		_, err = io.ReadFull(r, l)
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, l[0])
+		_, err = io.ReadFull(r, name)
+		if err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unknown socks5 address type %v", atyp[0])
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(r, port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func stripSocks5UDPHeader(packet []byte) ([]byte, error) {
+	if len(packet) < 4 {
+		return nil, errors.New("socks5 udp packet too short")
+	}
+	if packet[2] != 0 {
+		return nil, errors.New("socks5 udp fragment not supported")
+	}
+	r := bytes.NewReader(packet[3:])
+	_, err := readSocks5Addr(r)
+	if err != nil {
+		return nil, err
+	}
+	return packet[len(packet)-r.Len():], nil
+}
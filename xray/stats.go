@@ -0,0 +1,68 @@
+package xray
+
+import (
+	"math"
+	"sort"
+	"xray-helper/common"
+)
+
+// LatencyStats 单个节点多次采样的延迟统计，延迟单位为毫秒
+type LatencyStats struct {
+	Samples int     `json:"samples"`
+	Min     int     `json:"min"`
+	Median  int     `json:"median"`
+	P90     int     `json:"p90"`
+	Jitter  float64 `json:"jitter"`
+	Loss    float64 `json:"loss"`
+	Score   float64 `json:"score"`
+}
+
+// NewLatencyStats 由采样结果计算统计值，失败的采样用负数表示；
+// 全部失败时只有 Loss 有意义，不参与排名
+func NewLatencyStats(samples []int, weights common.ScoreConfig) LatencyStats {
+	stats := LatencyStats{Samples: len(samples), Loss: 1}
+	var ok []int
+	for _, s := range samples {
+		if s >= 0 {
+			ok = append(ok, s)
+		}
+	}
+	if len(samples) == 0 || len(ok) == 0 {
+		return stats
+	}
+	stats.Loss = float64(len(samples)-len(ok)) / float64(len(samples))
+
+	// 抖动取相邻两次成功采样差值的平均
+	if len(ok) > 1 {
+		var sum float64
+		for i := 1; i < len(ok); i++ {
+			sum += math.Abs(float64(ok[i] - ok[i-1]))
+		}
+		stats.Jitter = sum / float64(len(ok)-1)
+	}
+
+	sorted := append([]int(nil), ok...)
+	sort.Ints(sorted)
+	stats.Min = sorted[0]
+	stats.Median = percentile(sorted, 50)
+	stats.P90 = percentile(sorted, 90)
+	stats.Score = float64(stats.Median)*weights.Median +
+		float64(stats.P90)*weights.P90 +
+		stats.Jitter*weights.Jitter +
+		stats.Loss*weights.Loss
+	return stats
+}
+
+// Available 至少有一次采样成功
+func (s LatencyStats) Available() bool {
+	return s.Samples > 0 && s.Loss < 1
+}
+
+// percentile 最近秩法，sorted 需已升序排列且非空
+func percentile(sorted []int, p int) int {
+	rank := int(math.Ceil(float64(p) / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,63 @@
+package xray
+
+import (
+	"testing"
+	"xray-helper/common"
+)
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		name   string
+		sorted []int
+		p      int
+		want   int
+	}{
+		{"single", []int{5}, 90, 5},
+		{"median odd", []int{1, 2, 3}, 50, 2},
+		{"median even", []int{1, 2, 3, 4}, 50, 2},
+		{"p90 of ten", []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 90, 9},
+		{"p0 is min", []int{3, 7}, 0, 3},
+		{"p100 is max", []int{3, 7}, 100, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := percentile(tt.sorted, tt.p); got != tt.want {
+				t.Errorf("percentile(%v, %v) = %v, want %v", tt.sorted, tt.p, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewLatencyStats(t *testing.T) {
+	weights := common.ScoreConfig{Median: 1, P90: 0.5, Jitter: 0.5, Loss: 2000}
+	tests := []struct {
+		name      string
+		samples   []int
+		want      LatencyStats
+		available bool
+	}{
+		{"no samples", nil, LatencyStats{Loss: 1}, false},
+		{"all failed", []int{-1, -1}, LatencyStats{Samples: 2, Loss: 1}, false},
+		{
+			"all ok", []int{100, 300, 200},
+			LatencyStats{Samples: 3, Min: 100, Median: 200, P90: 300, Jitter: 150, Score: 200 + 150 + 75},
+			true,
+		},
+		{
+			"half lost", []int{100, -1},
+			LatencyStats{Samples: 2, Min: 100, Median: 100, P90: 100, Loss: 0.5, Score: 100 + 50 + 1000},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewLatencyStats(tt.samples, weights)
+			if got != tt.want {
+				t.Errorf("NewLatencyStats(%v) = %+v, want %+v", tt.samples, got, tt.want)
+			}
+			if got.Available() != tt.available {
+				t.Errorf("Available() = %v, want %v", got.Available(), tt.available)
+			}
+		})
+	}
+}
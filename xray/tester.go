@@ -0,0 +1,372 @@
+package xray
+
+import (
+	"context"
+	"errors"
+	log "github.com/golang/glog"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrTestRunning = errors.New("test already running")
+
+var ErrTestCancelled = errors.New("test cancelled")
+
+var ErrNoNodeToTest = errors.New("no node to test")
+
+var ErrNoNodeSelected = errors.New("no node available, keep current nodes")
+
+// NodeResult 一个节点在一轮测试中的结果
+type NodeResult struct {
+	Node       *V2Ray                `json:"-"`
+	Tag        string                `json:"tag"`
+	Latency    LatencyStats          `json:"latency"`
+	UDP        *UDPResult            `json:"udp,omitempty"`
+	Throughput *ThroughputResult     `json:"throughput,omitempty"`
+	Exit       *ExitInfo             `json:"exit,omitempty"`
+	Sites      map[string]SiteResult `json:"sites,omitempty"`
+	Error      string                `json:"error,omitempty"`
+	ErrorClass string                `json:"errorClass,omitempty"`
+}
+
+func (r NodeResult) Available() bool {
+	return r.Latency.Available()
+}
+
+// TestProgress 当前测试进度
+type TestProgress struct {
+	Running bool   `json:"running"`
+	Phase   string `json:"phase,omitempty"`
+	Done    int    `json:"done"`
+	Total   int    `json:"total"`
+}
+
+func (app *XrayApp) TestAll() error {
+	locked := app.testMu.TryLock()
+	if !locked {
+		return ErrTestRunning
+	}
+	defer app.testMu.Unlock()
+
+	start := time.Now()
+	err := app.testAll()
+	app.recordTestOutcome(start, err)
+	return err
+}
+
+func (app *XrayApp) testAll() error {
+	testConfig := app.config.Test
+	// runCtx 只用于取消测试；test.deadline 限制除带宽测试外的各阶段，带宽测试使用自己的时限
+	runCtx, cancel := context.WithCancel(context.Background())
+	app.setTestCancel(cancel)
+	defer func() {
+		app.setTestCancel(nil)
+		cancel()
+	}()
+	deadline := time.Duration(testConfig.Deadline) * time.Second
+	ctx, cancelRound := context.WithTimeout(runCtx, deadline)
+	defer cancelRound()
+
+	history, err := app.History()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	s := app.V2Rays
+	results := make([]NodeResult, len(s))
+	// pending 需要经由测试实例测试的节点在 s 中的下标
+	var pending []int
+	for i, v := range s {
+		results[i] = NodeResult{Node: v, Tag: v.GetTag("proxy_"), Error: "not tested", ErrorClass: ErrClassNotTested}
+		if testConfig.Quarantine.Enabled && !history.Admit(v.Key(), now) {
+			results[i].Error = "quarantined"
+			results[i].ErrorClass = ErrClassQuarantined
+			continue
+		}
+		pending = append(pending, i)
+	}
+	if testConfig.Prescreen.Enabled {
+		pending = app.PrescreenAll(ctx, results, pending)
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return ErrTestCancelled
+		}
+	}
+	if len(pending) == 0 {
+		app.recordHistory(results)
+		return ErrNoNodeToTest
+	}
+	nodes := make([]*V2Ray, len(pending))
+	for j, i := range pending {
+		nodes[j] = s[i]
+	}
+
+	inst, err := app.StartTestInstance(ctx, nodes)
+	if err != nil {
+		return err
+	}
+	defer inst.Stop()
+
+	app.runTests(ctx, "latency", len(pending), testConfig.Concurrency, func(ctx context.Context, j int) {
+		i := pending[j]
+		r := app.Test(ctx, inst, s[i])
+		log.Infof("test complete, %v: median %vms, loss %.2f", s[i].Ps, r.Latency.Median, r.Latency.Loss)
+		results[i] = r
+	})
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return ErrTestCancelled
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		log.Infof("timed out waiting for test tasks to finish, %v/%v done", app.testDone.Load(), len(pending))
+	}
+
+	if testConfig.Exit.Enabled {
+		app.TestExitAll(ctx, inst, results)
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return ErrTestCancelled
+		}
+	}
+
+	if len(testConfig.Sites) > 0 {
+		app.TestSitesAll(ctx, inst, results)
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return ErrTestCancelled
+		}
+	}
+
+	_, err = app.recordHistory(results)
+	if err != nil {
+		return err
+	}
+
+	// 本轮可用的节点，按历史加权评分排序
+	var available []NodeResult
+	effective := make(map[*V2Ray]float64)
+	for _, r := range results {
+		if !r.Available() {
+			continue
+		}
+		h, _ := history.Get(r.Node.Key())
+		effective[r.Node] = h.EffectiveScore(testConfig.Score)
+		available = append(available, r)
+	}
+	sort.SliceStable(available, func(i, j int) bool {
+		return effective[available[i].Node] < effective[available[j].Node]
+	})
+
+	if testConfig.Udp.Enabled {
+		app.TestUDPAll(ctx, inst, available)
+		history.RecordUDP(available)
+		err = history.Save()
+		if err != nil {
+			log.Errorf("save test history failed %v", err)
+		}
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return ErrTestCancelled
+		}
+	}
+
+	if testConfig.Throughput.Enabled {
+		throughputCtx, cancelThroughput := context.WithTimeout(runCtx, time.Duration(testConfig.Throughput.Deadline)*time.Second)
+		app.TestThroughputAll(throughputCtx, inst, available)
+		cancelThroughput()
+		if errors.Is(runCtx.Err(), context.Canceled) {
+			return ErrTestCancelled
+		}
+	}
+
+	// 本轮没有任何节点通过时不按历史评分保留当前节点，由下面的检查保留当前节点并返回错误
+	if len(available) > 0 {
+		available = app.withUntestedCurrent(available, results, history)
+	}
+
+	selected, entries := app.selectNodes(available, history)
+	app.selectionMu.Lock()
+	app.selection = entries
+	app.selectionMu.Unlock()
+
+	// 网络暂时中断或测试超时时可能没有节点可选，保留当前节点而不是清空 proxy-balancer，
+	// 返回错误使定时测试按 retryInterval 退避重试
+	if len(selected) == 0 {
+		log.Warningf("no node selected in this round, keep %v current nodes", len(app.Selected))
+		return ErrNoNodeSelected
+	}
+
+	ranked := make([]*V2Ray, len(available))
+	for i, r := range available {
+		ranked[i] = r.Node
+	}
+	return app.UpdateProxyOutbounds(selected, ranked)
+}
+
+// withUntestedCurrent 当前已选节点本轮因测试超时等原因没有测试时，按历史评分加入 available 参与选择，
+// 只有本轮测试失败的当前节点才会被替换
+func (app *XrayApp) withUntestedCurrent(available []NodeResult, results []NodeResult, history *HistoryStore) []NodeResult {
+	current := make(map[string]bool)
+	for _, v := range app.Selected {
+		current[v.Key()] = true
+	}
+	carried := false
+	for _, r := range results {
+		if r.ErrorClass == ErrClassNotTested && current[r.Node.Key()] {
+			log.Infof("keep untested current node %v", r.Node.Ps)
+			available = append(available, r)
+			carried = true
+		}
+	}
+	if !carried {
+		return available
+	}
+	scoreConfig := app.config.Test.Score
+	sort.SliceStable(available, func(i, j int) bool {
+		hi, _ := history.Get(available[i].Node.Key())
+		hj, _ := history.Get(available[j].Node.Key())
+		return hi.EffectiveScore(scoreConfig) < hj.EffectiveScore(scoreConfig)
+	})
+	return available
+}
+
+// recordHistory 将本轮结果记入测试历史并保存；
+// 本轮没有任何节点通过时多半是本地网络中断(或 DNS 不可用)，不记录失败也不更新隔离状态
+func (app *XrayApp) recordHistory(results []NodeResult) (*HistoryStore, error) {
+	history, err := app.History()
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(results, NodeResult.Available) {
+		log.Warningf("no node passed this round, possibly a local network failure, failures not recorded")
+		return history, nil
+	}
+	now := time.Now()
+	history.Record(results, app.config.Test.History, now)
+	if app.config.Test.Quarantine.Enabled {
+		history.UpdateQuarantine(results, app.config.Test.Quarantine, now)
+	}
+	err = history.Save()
+	if err != nil {
+		log.Errorf("save test history failed %v", err)
+	}
+	return history, nil
+}
+
+// runTests 用固定数量的 worker 对 0..n-1 执行 fn，ctx 结束后不再开始新的任务
+func (app *XrayApp) runTests(ctx context.Context, phase string, n int, concurrency int, fn func(context.Context, int)) {
+	app.testCancelMu.Lock()
+	app.testPhase = phase
+	app.testCancelMu.Unlock()
+	app.testDone.Store(0)
+	app.testTotal.Store(int64(n))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(ctx, i)
+				app.testDone.Add(1)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// Test 经由测试实例对节点采样 test.samples 次
+func (app *XrayApp) Test(ctx context.Context, inst *TestInstance, v *V2Ray) NodeResult {
+	result := NodeResult{Node: v, Tag: v.GetTag("proxy_")}
+	testConfig := app.config.Test
+	client, err := testClient(inst, v)
+	if err != nil {
+		result.Error = err.Error()
+		result.ErrorClass = ErrClassOther
+		return result
+	}
+	defer client.CloseIdleConnections()
+	timeout := time.Duration(testConfig.ProbeTimeout) * time.Second
+
+	var samples []int
+	for i := 0; i < testConfig.Samples && ctx.Err() == nil; i++ {
+		cost, err := probeAll(ctx, client, testConfig.Probes, timeout, v.GetTag("test_"))
+		if err != nil {
+			result.Error = err.Error()
+			result.ErrorClass = classifyError(err)
+		}
+		samples = append(samples, cost)
+	}
+	result.Latency = NewLatencyStats(samples, testConfig.Score)
+	if result.Available() {
+		result.Error = ""
+		result.ErrorClass = ""
+	}
+	// 整轮测试被取消或超时导致的失败不算节点的问题
+	if !result.Available() && ctx.Err() != nil {
+		result.ErrorClass = ErrClassNotTested
+	}
+	return result
+}
+
+// History 节点测试历史，首次调用时从 dataDir 加载
+func (app *XrayApp) History() (*HistoryStore, error) {
+	app.historyMu.Lock()
+	defer app.historyMu.Unlock()
+	if app.history != nil {
+		return app.history, nil
+	}
+	history, err := OpenHistoryStore(app.config.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	app.history = history
+	return history, nil
+}
+
+// testClient 返回经由测试实例中节点入站的 http client
+func testClient(inst *TestInstance, v *V2Ray) (*http.Client, error) {
+	addr, err := inst.ProxyAddr(v)
+	if err != nil {
+		return nil, err
+	}
+	return newProxyClient("socks5://" + addr)
+}
+
+func (app *XrayApp) setTestCancel(cancel context.CancelFunc) {
+	app.testCancelMu.Lock()
+	defer app.testCancelMu.Unlock()
+	app.testCancel = cancel
+}
+
+// CancelTest 取消正在进行的测试，没有测试时返回 false
+func (app *XrayApp) CancelTest() bool {
+	app.testCancelMu.Lock()
+	defer app.testCancelMu.Unlock()
+	if app.testCancel == nil {
+		return false
+	}
+	app.testCancel()
+	return true
+}
+
+func (app *XrayApp) TestProgress() TestProgress {
+	app.testCancelMu.Lock()
+	defer app.testCancelMu.Unlock()
+	running := app.testCancel != nil
+	return TestProgress{
+		Running: running,
+		Phase:   app.testPhase,
+		Done:    int(app.testDone.Load()),
+		Total:   int(app.testTotal.Load()),
+	}
+}
@@ -0,0 +1,200 @@
+package xray
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/golang/glog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// 测试实例启动后等待入站可用的最长时间
+const testInstanceStartTimeout = 10 * time.Second
+
+// 选出的空闲端口在 xray 绑定前可能被其他进程占用，启动失败时换端口重试的次数
+const testInstanceStartAttempts = 3
+
+var errNoTestableNode = errors.New("no node can be tested")
+
+// TestInstance 仅用于测试的短期 xray 进程，每个节点一个本地 socks 入站(支持 UDP)，
+// 与正式运行的 xray 互不影响；出站与正式出站相同，包括 sockopt/nodeSockopts 的 mark、interface，
+// 测试结果反映节点被选中后实际经过的网络路径
+type TestInstance struct {
+	dir   string
+	cmd   *exec.Cmd
+	exit  chan struct{}
+	ports map[*V2Ray]int
+}
+
+// StartTestInstance 在临时目录生成配置并启动测试用 xray，
+// 无法生成出站的节点没有测试入站；启动失败时重新选择端口重试
+func (app *XrayApp) StartTestInstance(ctx context.Context, nodes []*V2Ray) (*TestInstance, error) {
+	var err error
+	for attempt := 1; attempt <= testInstanceStartAttempts; attempt++ {
+		var inst *TestInstance
+		inst, err = app.startTestInstance(ctx, nodes)
+		if err == nil {
+			return inst, nil
+		}
+		if errors.Is(err, errNoTestableNode) || ctx.Err() != nil {
+			return nil, err
+		}
+		log.Warningf("test instance start failed, attempt %v/%v: %v", attempt, testInstanceStartAttempts, err)
+	}
+	return nil, err
+}
+
+func (app *XrayApp) startTestInstance(ctx context.Context, nodes []*V2Ray) (*TestInstance, error) {
+	dir, err := os.MkdirTemp("", "xray-helper-test-")
+	if err != nil {
+		return nil, err
+	}
+	inst := &TestInstance{
+		dir:   dir,
+		exit:  make(chan struct{}),
+		ports: make(map[*V2Ray]int),
+	}
+
+	var inbounds []Inbound
+	var outbounds []OutboundObject
+	var rules []RoutingRule
+	for i, v := range nodes {
+		outbound, err := app.TransferToOutbound(v, "test_")
+		if err != nil {
+			log.Errorf("test instance skip %v: %v", v.Ps, err)
+			continue
+		}
+		port, err := freePort()
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		inTag := "in-" + strconv.Itoa(i)
+		outbound.Tag = "out-" + strconv.Itoa(i)
+		inbounds = append(inbounds, Inbound{
+			Port:     port,
+			Protocol: "socks",
+			Listen:   "127.0.0.1",
+			Settings: &InboundSettings{
+				Auth: "noauth",
+				UDP:  true,
+				IP:   "127.0.0.1",
+			},
+			Tag: inTag,
+		})
+		outbounds = append(outbounds, outbound)
+		rules = append(rules, RoutingRule{
+			Type:        "field",
+			InboundTag:  []string{inTag},
+			OutboundTag: outbound.Tag,
+		})
+		inst.ports[v] = port
+	}
+	if len(inbounds) == 0 {
+		os.RemoveAll(dir)
+		return nil, errNoTestableNode
+	}
+
+	config := map[string]interface{}{
+		"log":       Log{Access: "none", Loglevel: "warning"},
+		"inbounds":  inbounds,
+		"outbounds": outbounds,
+		"routing": map[string]interface{}{
+			"rules": rules,
+		},
+	}
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	configPath := filepath.Join(dir, "config.json")
+	err = writeToFile(string(data), configPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	inst.cmd = exec.Command(app.xrayExe(), "run", "-c", configPath)
+	inst.cmd.Env = append(os.Environ(), "XRAY_LOCATION_ASSET="+app.config.XrayAssetDir)
+	err = inst.cmd.Start()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	go func() {
+		inst.cmd.Wait()
+		close(inst.exit)
+	}()
+
+	err = inst.waitReady(ctx, inbounds[len(inbounds)-1].Port)
+	if err != nil {
+		inst.Stop()
+		return nil, err
+	}
+	log.Infof("test instance started, pid %v, %v nodes", inst.cmd.Process.Pid, len(inbounds))
+	return inst, nil
+}
+
+// waitReady 等到最后一个入站可以连接，xray 按顺序创建入站
+func (inst *TestInstance) waitReady(ctx context.Context, port int) error {
+	ctx, cancel := context.WithTimeout(ctx, testInstanceStartTimeout)
+	defer cancel()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-inst.exit:
+			return fmt.Errorf("test instance exited: %v", inst.cmd.ProcessState)
+		case <-ctx.Done():
+			return fmt.Errorf("test instance not ready: %w", ctx.Err())
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// Port 节点的 socks 测试入站端口，没有时为 0
+func (inst *TestInstance) Port(v *V2Ray) int {
+	return inst.ports[v]
+}
+
+// ProxyAddr 节点的 socks 测试入站地址
+func (inst *TestInstance) ProxyAddr(v *V2Ray) (string, error) {
+	port := inst.Port(v)
+	if port == 0 {
+		return "", errors.New("no test inbound")
+	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), nil
+}
+
+// Stop 结束测试进程并删除临时配置
+func (inst *TestInstance) Stop() {
+	if inst.cmd != nil && inst.cmd.Process != nil {
+		err := inst.cmd.Process.Kill()
+		if err != nil && !errors.Is(err, os.ErrProcessDone) {
+			log.Errorf("test instance kill failed %v", err)
+		}
+		<-inst.exit
+	}
+	os.RemoveAll(inst.dir)
+}
+
+// freePort 系统分配的空闲端口，关闭监听后才由 xray 绑定，期间可能被占用
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
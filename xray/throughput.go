@@ -0,0 +1,98 @@
+package xray
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/golang/glog"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ThroughputResult 带宽测试结果，TTFB 单位为毫秒；
+// NotTested 为 true 时该节点的测试没有开始或被带宽测试时限打断，不按带宽排除
+type ThroughputResult struct {
+	Mbps      float64 `json:"mbps"`
+	TTFB      int     `json:"ttfb"`
+	Bytes     int64   `json:"bytes"`
+	Error     string  `json:"error,omitempty"`
+	NotTested bool    `json:"notTested,omitempty"`
+}
+
+// TestThroughputAll 对按评分排好序的前 candidates 个节点测试带宽，
+// ctx 结束时没有完成的节点标记为未测试，不使用不完整的结果
+func (app *XrayApp) TestThroughputAll(ctx context.Context, inst *TestInstance, ranked []NodeResult) {
+	config := app.config.Test.Throughput
+	n := len(ranked)
+	if n > config.Candidates {
+		n = config.Candidates
+	}
+	for i := 0; i < n; i++ {
+		ranked[i].Throughput = &ThroughputResult{Error: "not tested", NotTested: true}
+	}
+	app.runTests(ctx, "throughput", n, config.Concurrency, func(ctx context.Context, i int) {
+		r := app.TestThroughput(ctx, inst, ranked[i].Node)
+		if ctx.Err() != nil {
+			log.Infof("throughput test not complete, %v: %v", ranked[i].Node.Ps, ctx.Err())
+			return
+		}
+		log.Infof("throughput test complete, %v: %.2fMbps ttfb %vms %v", ranked[i].Node.Ps, r.Mbps, r.TTFB, r.Error)
+		ranked[i].Throughput = &r
+	})
+}
+
+// TestThroughput 经由节点下载 url 的前 bytes 字节，带宽按首字节之后的时间计算
+func (app *XrayApp) TestThroughput(ctx context.Context, inst *TestInstance, v *V2Ray) ThroughputResult {
+	config := app.config.Test.Throughput
+	var result ThroughputResult
+	client, err := testClient(inst, v)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer client.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.Timeout)*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "GET", config.Url, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	start := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		result.Error = fmt.Sprintf("unexpected status %v", response.StatusCode)
+		return result
+	}
+
+	// 先读一个字节得到首字节时间
+	first := make([]byte, 1)
+	_, err = io.ReadFull(response.Body, first)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	firstByte := time.Now()
+	result.TTFB = int(firstByte.Sub(start).Milliseconds())
+
+	n, err := io.Copy(io.Discard, io.LimitReader(response.Body, config.Bytes-1))
+	elapsed := time.Since(firstByte)
+	result.Bytes = n + 1
+	// 单个节点下载超时时已下载的数据仍可用于估算带宽
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		result.Error = err.Error()
+		return result
+	}
+	if elapsed > 0 {
+		result.Mbps = float64(n*8) / elapsed.Seconds() / 1e6
+	}
+	return result
+}
@@ -0,0 +1,103 @@
+package xray
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/golang/glog"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// UDPResult UDP 测试结果，Latency 单位为毫秒
+type UDPResult struct {
+	Supported bool   `json:"supported"`
+	Latency   int    `json:"latency"`
+	Error     string `json:"error,omitempty"`
+}
+
+// TestUDPAll 测试节点的 UDP 支持并记录到 V2Ray.UDP，
+// 测试超时或取消时未完成的节点不记录结果，保留之前的 UDP 支持
+func (app *XrayApp) TestUDPAll(ctx context.Context, inst *TestInstance, results []NodeResult) {
+	app.runTests(ctx, "udp", len(results), app.config.Test.Concurrency, func(ctx context.Context, i int) {
+		r := app.TestUDP(ctx, inst, results[i].Node)
+		if ctx.Err() != nil {
+			log.Infof("udp test not complete, %v: %v", results[i].Node.Ps, ctx.Err())
+			return
+		}
+		log.Infof("udp test complete, %v: %v %vms %v", results[i].Node.Ps, r.Supported, r.Latency, r.Error)
+		results[i].UDP = &r
+		results[i].Node.UDP = r.Supported
+	})
+}
+
+// TestUDP 经由测试实例中节点的 socks 入站发送一次 DNS 查询
+func (app *XrayApp) TestUDP(ctx context.Context, inst *TestInstance, v *V2Ray) UDPResult {
+	config := app.config.Test.Udp
+	var result UDPResult
+	proxyAddr, err := inst.ProxyAddr(v)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.Timeout)*time.Second)
+	defer cancel()
+
+	id := uint16(rand.Intn(1 << 16))
+	query, err := dnsQuery(id, config.Domain)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	start := time.Now()
+	answer, err := socks5UDPExchange(ctx, proxyAddr, config.DnsServer, query)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	err = checkDnsAnswer(id, answer)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Supported = true
+	result.Latency = int(time.Since(start).Milliseconds())
+	return result
+}
+
+func dnsQuery(id uint16, domain string) ([]byte, error) {
+	// header: id, flags(RD), qdcount=1
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0)
+	for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid domain '%v'", domain)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	// root, qtype A, qclass IN
+	msg = append(msg, 0, 0, 1, 0, 1)
+	return msg, nil
+}
+
+func checkDnsAnswer(id uint16, msg []byte) error {
+	if len(msg) < 12 {
+		return errors.New("dns answer too short")
+	}
+	if binary.BigEndian.Uint16(msg) != id {
+		return errors.New("dns answer id mismatch")
+	}
+	if msg[2]&0x80 == 0 {
+		return errors.New("dns answer is not a response")
+	}
+	if rcode := msg[3] & 0x0f; rcode != 0 {
+		return fmt.Errorf("dns answer rcode %v", rcode)
+	}
+	if binary.BigEndian.Uint16(msg[6:]) == 0 {
+		return errors.New("dns answer is empty")
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package xray
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	log "github.com/golang/glog"
 	jsoniter "github.com/json-iterator/go"
@@ -37,6 +39,14 @@ type V2Ray struct {
 	AllowInsecure bool   `json:"allowInsecure"`
 	V             string `json:"v"`
 	Protocol      string `json:"protocol"`
+	// UDP 最近一次测试确认节点支持 UDP
+	UDP bool `json:"-"`
+	// Subscription 节点所属订阅的名称
+	Subscription string `json:"-"`
+	// Exit 最近一次测试查询到的出口 IP 及所在地
+	Exit *ExitInfo `json:"-"`
+	// Sites 最近一次站点检查中各站点是否可用
+	Sites map[string]bool `json:"-"`
 }
 
 func (v *V2Ray) TransferToOutbound(prefix string) (OutboundObject, error) {
@@ -223,6 +233,16 @@ func (v *V2Ray) TransferToOutbound(prefix string) (OutboundObject, error) {
 
 }
 
+// Key 节点的稳定标识，由连接参数计算，不受备注变化影响
+func (v *V2Ray) Key() string {
+	h := sha1.New()
+	for _, s := range []string{v.Protocol, v.Add, strconv.Itoa(v.Port), v.ID, v.Net, v.Type, v.Host, v.Path, v.TLS, v.SNI} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
 func (v *V2Ray) GetTag(prefix string) string {
 	tag := prefix + "-" + v.Ps
 	tag = strings.ReplaceAll(tag, " ", "")
@@ -333,6 +353,10 @@ func ParseVmessURL(vmess string) (data *V2Ray, err error) {
 		if err != nil {
 			return
 		}
+		// 分享链接中指纹字段通常为 fp
+		if info.Fingerprint == "" {
+			info.Fingerprint = gjson.Get(raw, "fp").String()
+		}
 	}
 	// correct the wrong vmess as much as possible
 	if strings.HasPrefix(info.Host, "/") && info.Path == "" {
@@ -0,0 +1,120 @@
+package xray
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/golang/glog"
+	"net"
+	"strconv"
+	"time"
+)
+
+// WatchdogStatus watchdog 当前状态
+type WatchdogStatus struct {
+	Enabled   bool      `json:"enabled"`
+	Failures  int       `json:"failures"`
+	LastCheck time.Time `json:"lastCheck,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+	// LastTrigger 最近一次由 watchdog 触发重新测试的时间，Cooldown 当前最小间隔(秒)
+	LastTrigger time.Time `json:"lastTrigger,omitempty"`
+	Triggers    int       `json:"triggers"`
+	Cooldown    int       `json:"cooldown"`
+	// recovering 上次重新测试后还没有检查成功过
+	recovering bool
+}
+
+// Watchdog 开启时在后台定时检查正式入站，连续失败 watchdog.failures 次后立即重新测试
+func (app *XrayApp) Watchdog() {
+	wc := app.config.Watchdog
+	if !wc.Enabled {
+		return
+	}
+	app.watchdogMu.Lock()
+	app.watchdog = WatchdogStatus{Enabled: true, Cooldown: wc.Cooldown}
+	app.watchdogMu.Unlock()
+	go func() {
+		ticker := time.NewTicker(time.Duration(wc.Interval) * time.Second)
+		for range ticker.C {
+			app.watchdogCheck()
+		}
+	}()
+}
+
+func (app *XrayApp) watchdogCheck() {
+	wc := app.config.Watchdog
+	err := app.checkInbounds(context.Background())
+
+	app.watchdogMu.Lock()
+	status := &app.watchdog
+	status.LastCheck = time.Now()
+	if err == nil {
+		status.Failures = 0
+		status.LastError = ""
+		status.Cooldown = wc.Cooldown
+		status.recovering = false
+		app.watchdogMu.Unlock()
+		return
+	}
+	status.Failures++
+	status.LastError = err.Error()
+	log.Errorf("watchdog check failed (%v/%v): %v", status.Failures, wc.Failures, err)
+	if status.Failures < wc.Failures {
+		app.watchdogMu.Unlock()
+		return
+	}
+	cooldown := time.Duration(status.Cooldown) * time.Second
+	if !status.LastTrigger.IsZero() && time.Since(status.LastTrigger) < cooldown {
+		app.watchdogMu.Unlock()
+		return
+	}
+	// 上次重新测试后仍然失败，下一次需要等待更久
+	if status.recovering {
+		status.Cooldown = min(status.Cooldown*2, wc.MaxCooldown)
+	}
+	status.LastTrigger = time.Now()
+	status.Triggers++
+	status.recovering = true
+	app.watchdogMu.Unlock()
+
+	log.Info("watchdog triggering test...")
+	err = app.TestAll()
+	if errors.Is(err, ErrTestRunning) {
+		return
+	}
+	if err != nil {
+		log.Errorf("watchdog test failed %v", err)
+	}
+	app.watchdogMu.Lock()
+	app.watchdog.Failures = 0
+	app.watchdogMu.Unlock()
+}
+
+// checkInbounds 经由配置的正式入站依次请求 test.probes
+func (app *XrayApp) checkInbounds(ctx context.Context) error {
+	timeout := time.Duration(app.config.Test.ProbeTimeout) * time.Second
+	for _, in := range app.config.Watchdog.Inbounds {
+		port := app.config.HttpPort
+		scheme := "http://"
+		if in == "socks" {
+			port = app.config.SocksPort
+			scheme = "socks5://"
+		}
+		client, err := newProxyClient(scheme + net.JoinHostPort(app.config.Address, strconv.Itoa(int(port))))
+		if err != nil {
+			return err
+		}
+		_, err = probeAll(ctx, client, app.config.Test.Probes, timeout, "watchdog-"+in)
+		client.CloseIdleConnections()
+		if err != nil {
+			return fmt.Errorf("%v inbound: %w", in, err)
+		}
+	}
+	return nil
+}
+
+func (app *XrayApp) WatchdogStatus() WatchdogStatus {
+	app.watchdogMu.Lock()
+	defer app.watchdogMu.Unlock()
+	return app.watchdog
+}
@@ -3,19 +3,19 @@ package xray
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	log "github.com/golang/glog"
 	"io"
-	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"sort"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 	"xray-helper/common"
@@ -27,16 +27,60 @@ var PrefixTest = "009_test_"
 
 var PrefixProxy = "009_proxy_"
 
+const proxyFileSuffix = "_tail.json"
+
 type XrayApp struct {
 	config  common.XrayConfig
 	Process *os.Process
 	V2Rays  []*V2Ray
-	testMu  sync.Mutex
-	startMu sync.Mutex
-	killMu  sync.Mutex
+	// Selected 当前写入 proxy-balancer 的节点，candidates 供命名负载均衡选择的节点
+	Selected   []*V2Ray
+	candidates []*V2Ray
+	testMu     sync.Mutex
+	// 当前测试的取消函数与进度
+	testCancel   context.CancelFunc
+	testCancelMu sync.Mutex
+	testPhase    string
+	testDone     atomic.Int64
+	testTotal    atomic.Int64
+	selection    []SelectionEntry
+	selectionMu  sync.Mutex
+	history      *HistoryStore
+	historyMu    sync.Mutex
+	meta         *NodeMetaStore
+	metaMu       sync.Mutex
+	grpcClient   *GrpcClient
+	grpcMu       sync.Mutex
+	// applyMu 串行化 proxy 出站文件的重写及通过 api 的更新
+	applyMu sync.Mutex
+	// activeTags 正在运行的 xray 中的 proxy 出站及其配置文件内容的摘要
+	activeTags map[string]string
+	activeMu   sync.Mutex
+	watchdog   WatchdogStatus
+	watchdogMu sync.Mutex
+	schedule   ScheduleStatus
+	scheduleMu sync.Mutex
+	sites      SiteMatrix
+	siteMu     sync.Mutex
+	// prescreen 最近一次直接连接检查的结果
+	prescreen   []PrescreenResult
+	prescreenMu sync.Mutex
+	// geoip 查询出口国家用的 geoip.dat，只加载一次
+	geoip     *geoIPTable
+	geoipOnce sync.Once
+	startMu   sync.Mutex
+	killMu    sync.Mutex
+	// overrides 通过 /routing/balancer 固定的负载均衡出站，替换路由后恢复，重启 xray 后清空
+	overrides  map[string]string
+	overrideMu sync.Mutex
+	// configMu 保护运行时替换的 config，domainMu 串行化域名列表的修改
+	configMu sync.Mutex
+	domainMu sync.Mutex
 }
 
 func NewXrayApp(config common.XrayConfig) *XrayApp {
+	// buildRouting 在本进程中通过 xray-core 读取 geosite/geoip
+	os.Setenv("XRAY_LOCATION_ASSET", config.XrayAssetDir)
 	CurrentXrayApp = &XrayApp{config: config}
 	return CurrentXrayApp
 }
@@ -46,11 +90,12 @@ func (app *XrayApp) Start() error {
 	if err != nil {
 		return err
 	}
+	if !*app.config.Schedule.RunOnStart {
+		return nil
+	}
 	err = app.TestAll()
 	if err != nil {
 		log.Errorf("test all config failed %v", err)
-	} else {
-		app.Restart(false)
 	}
 
 	return nil
@@ -78,135 +123,17 @@ func (app *XrayApp) DoStart() error {
 	return nil
 }
 
-func (app *XrayApp) TestAll() error {
-	locked := app.testMu.TryLock()
-	if !locked {
-		return nil
-	}
-	defer app.testMu.Unlock()
-
-	costTimeMap := make(map[*V2Ray]int)
-
-	var wg sync.WaitGroup
-	resultCh := make(chan struct {
-		v    *V2Ray
-		cost int
-	}, len(app.V2Rays))
-
-	s := app.V2Rays
-	if len(app.V2Rays) != 0 {
-		for _, v := range s {
-
-			wg.Add(1)
-			go func(v *V2Ray) {
-				defer func() {
-					if r := recover(); r != nil {
-						log.Errorf("test timeout: %v", r)
-					}
-				}()
-				defer wg.Done()
-				cost := app.Test(v)
-				log.Infof("test complete, %v:%v", v.Ps, cost)
-				resultCh <- struct {
-					v    *V2Ray
-					cost int
-				}{v: v, cost: cost}
-			}(v)
-		}
-	}
-
-	go func() {
-		timeout := time.After(20 * time.Second)
-		// 这是一个用于等待所有goroutine完成的channel
-		done := make(chan struct{})
-		go func() {
-			wg.Wait()
-			close(done)
-		}()
-		// 使用一个select语句来等待done或timeout信号
-		select {
-		case <-done:
-		// 如果done channel关闭，那么这个case变为可选择的，这表明所有的任务已经完成
-		case <-timeout:
-			// 如果从timeout channel中接收到值，那么这个case变为可选择的，这表明已经超时
-			log.Infof("timed out waiting for test tasks to finish")
-		}
-
-		// 不论是所有任务已经完成，还是已经超时，我们都关闭resultCh，以便于接收结果的goroutine可以结束
-		close(resultCh)
-	}()
-
-	for result := range resultCh {
-		costTimeMap[result.v] = result.cost
-	}
-
-	err := app.RemoveFiles(PrefixProxy)
-	if err != nil {
-		return err
-	}
-
-	var available []*V2Ray
-	for k, v := range costTimeMap {
-		if v > 0 {
-			available = append(available, k)
-		}
-	}
-
-	sort.Slice(available, func(i, j int) bool {
-		return costTimeMap[available[i]] < costTimeMap[available[j]]
-	})
-	if len(available) > 5 {
-		available = available[:5]
-	}
-	for _, v := range available {
-		err := app.V2rayToOutboundProxy(v)
-		if err != nil {
-			log.Errorf("V2rayToOutboundProxy error %v", err)
-			continue
-		}
-	}
-
-	return nil
+func (app *XrayApp) xrayExe() string {
+	return filepath.Join(app.config.XrayExeDir, "xray")
 }
 
-func (app *XrayApp) Test(v *V2Ray) int {
-	proxyUrlStr := "http://127.0.0.1:" + strconv.Itoa(int(app.config.TestPort))
-	proxyUrl, err := url.Parse(proxyUrlStr)
-	if err != nil {
-		log.Errorf("proxy url parse error %v", err)
-		return -1
-	}
-	transport := &http.Transport{
-		Proxy: http.ProxyURL(proxyUrl),
-	}
-
-	client := &http.Client{
-		Transport: transport,
-	}
-	request, err := http.NewRequest("GET", "http://www.google.com/ncr", nil)
-	if err != nil {
-		log.Errorf("http NewRequest error %v", err)
-		return -1
-	}
-	source := url.QueryEscape(v.GetTag("test_"))
-	request.Header.Set("source", source)
-
-	now := time.Now().UnixMilli()
-	response, err := client.Do(request)
-	cost := time.Now().UnixMilli() - now
+func (app *XrayApp) Run() error {
+	err := app.loadActiveTags()
 	if err != nil {
-		log.Errorf("test failed: %s call google filed  %v", v.GetTag("test_"), err)
-		return -1
-	}
-	if response.StatusCode < 200 || response.StatusCode >= 400 {
-		log.Errorf("test failed: %s StatusCode is %v ", v.GetTag("test_"), response.StatusCode)
-		return -1
+		return err
 	}
-	return int(cost)
-}
-func (app *XrayApp) Run() error {
-	xrayExe := filepath.Join(app.config.XrayExeDir, "xray")
-	cmd := exec.Command(xrayExe, "run", "-confdir", app.config.XrayConfigDir)
+	app.resetOverrides()
+	cmd := exec.Command(app.xrayExe(), "run", "-confdir", app.config.XrayConfigDir)
 	cmd.Env = append(os.Environ(), "XRAY_LOCATION_ASSET="+app.config.XrayAssetDir)
 	stdout, _ := cmd.StdoutPipe()
 	scanner := bufio.NewScanner(stdout)
@@ -215,7 +142,7 @@ func (app *XrayApp) Run() error {
 			log.Infof("stuout if xray ------- %s", scanner.Text())
 		}
 	}()
-	err := cmd.Start()
+	err = cmd.Start()
 	if err != nil {
 		return err
 	}
@@ -261,25 +188,48 @@ func (app *XrayApp) InitConfig() error {
 	if err != nil {
 		return err
 	}
+	err = app.InitObservatoryConfig()
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
 func (app *XrayApp) InitRouteConfig() error {
+	data, err := app.routeConfig()
+	if err != nil {
+		return err
+	}
+	fileName := "006route.json"
+	filePath := filepath.Join(app.config.XrayConfigDir, fileName)
+	err = writeToFile(data, filePath)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// routeConfig 生成路由配置
+func (app *XrayApp) routeConfig() (string, error) {
 	templateText := `
 {
     "routing": {
         "domainStrategy": "AsIs",
         "domainMatcher": "hybrid",
         "rules": [
+{{range .BalancerDomains}}
             {
                 "type": "field",
-                "domain": [
-{{range .DomainWhitelist}}
-                    "{{.}}",
+                "domain": {{.DomainsJson}},
+                "network": "tcp",
+                "inboundTag": ["inbounds-socks","inbounds-http"],
+                "ruleTag": "{{.Tag}}",
+                "balancerTag": "{{.Tag}}"
+            },
 {{end}}
-                    "geosite:cn",
-                    "geosite:geolocation-cn"
-                ],
+            {
+                "type": "field",
+                "domain": {{.WhitelistJson}},
                 "ip": [],
                 "network": "tcp",
                 "source": [],
@@ -287,6 +237,7 @@ func (app *XrayApp) InitRouteConfig() error {
                 "inboundTag": ["inbounds-socks","inbounds-http"],
                 "protocol": [],
                 "attrs": {},
+                "ruleTag": "whitelist",
                 "outboundTag": "direct"
             },
             {
@@ -309,16 +260,12 @@ func (app *XrayApp) InitRouteConfig() error {
                 "inboundTag": ["inbounds-socks","inbounds-http"],
                 "protocol": [],
                 "attrs": {},
+                "ruleTag": "direct-ip",
                 "outboundTag": "direct"
             },
             {
                 "type": "field",
-                "domain": [
-{{range .DomainBlacklist}}
-                    "{{.}}",
-{{end}}
-                    "geosite:geolocation-!cn"
-                ],
+                "domain": {{.BlacklistJson}},
                 "ip": [],
                 "network": "tcp",
                 "source": [],
@@ -326,6 +273,7 @@ func (app *XrayApp) InitRouteConfig() error {
                 "inboundTag": ["inbounds-socks","inbounds-http"],
                 "protocol": [],
                 "attrs": {},
+                "ruleTag": "blacklist",
                 "balancerTag": "proxy-balancer"
             },
             {
@@ -340,13 +288,37 @@ func (app *XrayApp) InitRouteConfig() error {
                 "inboundTag": ["inbounds-socks","inbounds-http"],
                 "protocol": [],
                 "attrs": {},
+                "ruleTag": "proxy-ip",
                 "balancerTag": "proxy-balancer"
             },
+{{if .Test.Udp.Route}}
+            {
+                "type": "field",
+                "domain": [
+                    "geosite:geolocation-!cn"
+                ],
+                "network": "udp",
+                "inboundTag": ["inbounds-socks"],
+                "ruleTag": "udp-proxy-domain",
+                "balancerTag": "proxy-udp-balancer"
+            },
+            {
+                "type": "field",
+                "ip": [
+                    "geoip:!cn"
+                ],
+                "network": "udp",
+                "inboundTag": ["inbounds-socks"],
+                "ruleTag": "udp-proxy-ip",
+                "balancerTag": "proxy-udp-balancer"
+            },
+{{end}}
             {
                 "type": "field",
                 "inboundTag": [
                     "api"
                 ],
+                "ruleTag": "api",
                 "outboundTag": "api"
             },
             {
@@ -362,72 +334,168 @@ func (app *XrayApp) InitRouteConfig() error {
                 "inboundTag": [],
                 "protocol": [],
                 "attrs": {},
+                "ruleTag": "ads",
                 "outboundTag": "blocked"
             }
         ],
-        "balancers": [
-            {
-                "tag": "proxy-balancer",
-                "selector": [
-                    "proxy"
-                ]
-            }
-        ]
+        "balancers": {{.BalancersJson}}
     }
 }
 `
 	t := template.New("route template")
 	_, err := t.Parse(templateText)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	config := app.config
+	// 用户输入的域名等经 json 编码后写入，避免生成无效的配置文件
+	balancers, err := json.MarshalIndent(app.balancers(), "        ", "    ")
+	if err != nil {
+		return "", err
+	}
+	config := app.configSnapshot()
+	whitelist, err := json.Marshal(append(append([]string{}, config.DomainWhitelist...), "geosite:cn", "geosite:geolocation-cn"))
+	if err != nil {
+		return "", err
+	}
+	blacklist, err := json.Marshal(append(append([]string{}, config.DomainBlacklist...), "geosite:geolocation-!cn"))
+	if err != nil {
+		return "", err
+	}
+	type balancerDomains struct {
+		Tag         string
+		DomainsJson string
+	}
+	var domains []balancerDomains
+	for _, nb := range config.Balancers {
+		if len(nb.Domains) == 0 {
+			continue
+		}
+		d, err := json.Marshal(nb.Domains)
+		if err != nil {
+			return "", err
+		}
+		domains = append(domains, balancerDomains{Tag: NamedBalancerTag(nb.Name), DomainsJson: string(d)})
+	}
+	data := struct {
+		common.XrayConfig
+		BalancersJson   string
+		WhitelistJson   string
+		BlacklistJson   string
+		BalancerDomains []balancerDomains
+	}{config, string(balancers), string(whitelist), string(blacklist), domains}
 	var buf bytes.Buffer
-	err = t.Execute(&buf, config)
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+func (app *XrayApp) InitBaseOutboundConfig() error {
+	direct := OutboundObject{
+		Tag:      "direct",
+		Protocol: "freedom",
+	}
+	config := app.configSnapshot()
+	direct.StreamSettings.Sockopt = toSockopt(config.Sockopt)
+	freedom := config.Freedom
+	if freedom.Fragment.Enabled {
+		direct.Settings.Fragment = &Fragment{
+			Packets:  freedom.Fragment.Packets,
+			Length:   freedom.Fragment.Length,
+			Interval: freedom.Fragment.Interval,
+		}
+	}
+	if freedom.Noise.Enabled {
+		for _, n := range freedom.Noise.Noises {
+			direct.Settings.Noises = append(direct.Settings.Noises, Noise{
+				Type:   n.Type,
+				Packet: n.Packet,
+				Delay:  n.Delay,
+			})
+		}
+	}
+	m := map[string]interface{}{
+		"outbounds": []OutboundObject{
+			direct,
+			{Tag: "blocked", Protocol: "blackhole"},
+			{Tag: "api", Protocol: "freedom"},
+		},
+	}
+	data, err := json.MarshalIndent(m, "", "    ")
 	if err != nil {
 		return err
 	}
-
-	data := buf.String()
-	fileName := "006route.json"
-	filePath := filepath.Join(app.config.XrayConfigDir, fileName)
-	err = writeToFile(data, filePath)
+	fileName := "006base_outbound.json"
+	filePath := filepath.Join(config.XrayConfigDir, fileName)
+	err = writeToFile(string(data), filePath)
 	if err != nil {
 		return err
 	}
 	return nil
 }
-func (app *XrayApp) InitBaseOutboundConfig() error {
-	data := `
-{
-    "outbounds": [
-        {
-            "protocol": "freedom",
-            "settings": {},
-            "tag": "direct"
-        },
-        {
-            "protocol": "blackhole",
-            "settings": {},
-            "tag": "blocked"
-        },
-        {
-            "protocol": "freedom",
-            "settings": {},
-            "tag": "api"
-        }
-  ]
+
+// AntiCensorship 当前 direct 出站分片/噪声及默认 uTLS 指纹设置
+type AntiCensorship struct {
+	Fragment    bool   `json:"fragment"`
+	Noise       bool   `json:"noise"`
+	Fingerprint string `json:"fingerprint"`
 }
 
-`
-	fileName := "006base_outbound.json"
-	filePath := filepath.Join(app.config.XrayConfigDir, fileName)
-	err := writeToFile(data, filePath)
+func (app *XrayApp) GetAntiCensorship() AntiCensorship {
+	config := app.configSnapshot()
+	return AntiCensorship{
+		Fragment:    config.Freedom.Fragment.Enabled,
+		Noise:       config.Freedom.Noise.Enabled,
+		Fingerprint: config.Fingerprint,
+	}
+}
+
+// SetAntiCensorship 修改设置后重新生成出站配置并重启 xray，仅在内存中生效
+func (app *XrayApp) SetAntiCensorship(ac AntiCensorship) error {
+	err := common.CheckFingerprint(ac.Fingerprint)
 	if err != nil {
 		return err
 	}
-	return nil
+	app.updateConfig(func(config *common.XrayConfig) {
+		config.Freedom.Fragment.Enabled = ac.Fragment
+		config.Freedom.Noise.Enabled = ac.Noise
+		config.Fingerprint = ac.Fingerprint
+	})
+
+	err = app.writeAntiCensorshipOutbounds()
+	if err != nil {
+		return err
+	}
+	return app.Restart(false)
+}
+
+// writeAntiCensorshipOutbounds 按当前设置重写 direct 及 proxy 出站文件
+func (app *XrayApp) writeAntiCensorshipOutbounds() error {
+	app.applyMu.Lock()
+	defer app.applyMu.Unlock()
+	err := app.InitBaseOutboundConfig()
+	if err != nil {
+		return err
+	}
+	outbounds, _ := app.proxyOutbounds(app.Selected, app.candidates)
+	return app.writeProxyOutbounds(outbounds)
+}
+
+// configSnapshot 当前配置的副本，运行时可修改的设置(anticensorship、域名列表)须通过副本读取
+func (app *XrayApp) configSnapshot() common.XrayConfig {
+	app.configMu.Lock()
+	defer app.configMu.Unlock()
+	return app.config
+}
+
+// updateConfig 在当前配置的副本上修改后替换，update 中不能修改共享的 slice/map 元素
+func (app *XrayApp) updateConfig(update func(config *common.XrayConfig)) {
+	app.configMu.Lock()
+	defer app.configMu.Unlock()
+	config := app.config
+	update(&config)
+	app.config = config
 }
 
 func (app *XrayApp) InitInboundConfig() error {
@@ -438,7 +506,7 @@ func (app *XrayApp) InitInboundConfig() error {
         "listen": "0.0.0.0",
         "port": {{.SocksPort}},
         "protocol": "socks",
-        "settings": {},
+        "settings": {{if .Test.Udp.Route}}{"udp": true}{{else}}{}{{end}},
         "streamSettings": {},
         "tag": "inbounds-socks",
         "sniffing": {
@@ -472,21 +540,6 @@ func (app *XrayApp) InitInboundConfig() error {
             "address": "127.0.0.1"
         },
         "tag": "api"
-    },
-    {
-      "listen": "127.0.0.1",
-      "port": {{.TestPort}},
-      "protocol": "http",
-      "settings": {},
-      "streamSettings": {},
-      "tag": "inbounds-test",
-      "sniffing": {
-        "enabled": true,
-        "destOverride": ["http", "tls"]
-      },
-      "allocate": {
-        "strategy": "always"
-      }
     }
     ]
   }
@@ -612,65 +665,123 @@ func (app *XrayApp) InitLogConfig() error {
 	return nil
 }
 func (app *XrayApp) InitApiConfig() error {
-	data := `
-{
-  "api": {
-    "tag": "api",
-    "services": [
-      "HandlerService",
-      "LoggerService",
-      "StatsService"
-    ]
-  }
-}
-`
+	api := APIObject{
+		Tag:      "api",
+		Services: []string{"HandlerService", "RoutingService", "LoggerService", "StatsService"},
+	}
+	// 没有 observatory 时 ObservatoryService 会导致 xray 无法启动
+	if app.config.Observatory.Enabled {
+		api.Services = append(api.Services, "ObservatoryService")
+	}
+	data, err := json.MarshalIndent(map[string]interface{}{"api": api}, "", "  ")
+	if err != nil {
+		return err
+	}
 	fileName := "001api.json"
 	filePath := filepath.Join(app.config.XrayConfigDir, fileName)
-	err := writeToFile(data, filePath)
+	err = writeToFile(string(data), filePath)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// InitObservatoryConfig 生成探测 proxy 节点的 observatory/burstObservatory，未开启时删除
+func (app *XrayApp) InitObservatoryConfig() error {
+	fileName := "007observatory.json"
+	filePath := filepath.Join(app.config.XrayConfigDir, fileName)
+	oc := app.config.Observatory
+	if !oc.Enabled {
+		err := os.Remove(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var m map[string]interface{}
+	if oc.Burst {
+		m = map[string]interface{}{
+			"burstObservatory": BurstObservatory{
+				SubjectSelector: app.observatorySubjects(),
+				PingConfig: &PingConfig{
+					Destination:  oc.ProbeUrl,
+					Connectivity: oc.Connectivity,
+					Interval:     oc.ProbeInterval,
+					Sampling:     oc.Sampling,
+					Timeout:      oc.Timeout,
+				},
+			},
+		}
+	} else {
+		m = map[string]interface{}{
+			"observatory": Observatory{
+				SubjectSelector:   app.observatorySubjects(),
+				ProbeURL:          oc.ProbeUrl,
+				ProbeInterval:     oc.ProbeInterval,
+				EnableConcurrency: true,
+			},
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeToFile(string(data), filePath)
+}
+
 func (app *XrayApp) Subscribe(isProxy bool) error {
 
-	subscribeUrl := app.config.SubscribeUrl
-	if subscribeUrl == "" {
+	subscriptions := app.config.Subscriptions
+	if len(subscriptions) == 0 {
 		return nil
 	}
 	proxyUrl := "http://127.0.0.1:" + strconv.Itoa(int(app.config.HttpPort))
 	if !isProxy {
 		proxyUrl = ""
 	}
-	subscribeDecodeText, err := Subscribe(subscribeUrl, proxyUrl)
-	if err != nil {
-		return err
-	}
-	subscribeDecodeText = strings.TrimSpace(subscribeDecodeText)
-	lines := strings.Split(subscribeDecodeText, "\n")
 
 	var v2rays []*V2Ray
-	for _, line := range lines {
-		v2rayObj, err := ParseVmessURL(line)
+	var lastErr error
+	for _, sub := range subscriptions {
+		subV2rays, err := app.subscribeOne(sub, proxyUrl)
 		if err != nil {
-			return err
+			log.Errorf("subscribe '%v' failed %v", sub.Name, err)
+			lastErr = err
+			continue
 		}
-		v2rays = append(v2rays, v2rayObj)
+		v2rays = append(v2rays, subV2rays...)
+	}
+	if len(v2rays) == 0 && lastErr != nil {
+		return lastErr
 	}
 	app.V2Rays = v2rays
-	err = app.UpdateRoutingRule(v2rays)
+	err := app.UpdateOutbound(v2rays)
 	if err != nil {
 		return err
 	}
 
-	err = app.UpdateOutbound(v2rays)
+	return nil
+
+}
+
+func (app *XrayApp) subscribeOne(sub common.SubscriptionConfig, proxyUrl string) ([]*V2Ray, error) {
+	subscribeDecodeText, err := Subscribe(sub.Url, proxyUrl)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	subscribeDecodeText = strings.TrimSpace(subscribeDecodeText)
+	lines := strings.Split(subscribeDecodeText, "\n")
 
-	return nil
-
+	var v2rays []*V2Ray
+	for _, line := range lines {
+		v2rayObj, err := ParseVmessURL(line)
+		if err != nil {
+			return nil, err
+		}
+		v2rayObj.Subscription = sub.Name
+		v2rays = append(v2rays, v2rayObj)
+	}
+	return v2rays, nil
 }
 
 func (app *XrayApp) RemoveFiles(prefix string) error {
@@ -701,170 +812,173 @@ func (app *XrayApp) RemoveFiles(prefix string) error {
 
 func (app *XrayApp) UpdateOutbound(v2rays []*V2Ray) error {
 
+	// 旧版本写入正式配置的测试出站，测试已改为独立的测试实例
 	err := app.RemoveFiles(PrefixTest)
 	if err != nil {
 		return err
 	}
 
-	err = app.RemoveFiles(PrefixProxy)
+	app.restoreNodeAttrs(v2rays)
+	// 先使用上次测试选出的节点，避免测试完成前负载均衡中包含不可用的节点
+	v2rays = app.withoutQuarantined(v2rays)
+	selected, candidates := app.restoreSelected(v2rays)
+	if pinned := app.pinnedNodes(v2rays, false); len(pinned) > 0 {
+		selected = pinned
+	}
+	app.applyMu.Lock()
+	defer app.applyMu.Unlock()
+	outbounds, written := app.proxyOutbounds(selected, candidates)
+	err = app.writeProxyOutbounds(outbounds)
 	if err != nil {
 		return err
 	}
-
-	for _, v := range v2rays {
-		err := app.V2rayToOutbound(v)
-		if err != nil {
-			return err
-		}
-	}
-	return err
+	app.Selected = written
+	app.candidates = candidates
+	return nil
 }
 
-func (app *XrayApp) V2rayToOutbound(v *V2Ray) error {
-	err := app.V2rayToOutboundTest(v)
+// TransferToOutbound 在节点自身配置之上应用全局默认设置
+func (app *XrayApp) TransferToOutbound(v *V2Ray, prefix string) (OutboundObject, error) {
+	core, err := v.TransferToOutbound(prefix)
 	if err != nil {
-		return err
+		return core, err
 	}
-	err = app.V2rayToOutboundProxy(v)
-	if err != nil {
-		return err
+	fp := app.configSnapshot().Fingerprint
+	if fp != "" {
+		if tls := core.StreamSettings.TLSSettings; tls != nil && tls.Fingerprint == "" {
+			tls.Fingerprint = fp
+		}
+		if reality := core.StreamSettings.RealitySettings; reality != nil && reality.Fingerprint == "" {
+			reality.Fingerprint = fp
+		}
 	}
-	return nil
+	core.StreamSettings.Sockopt = toSockopt(app.SockoptFor(v))
+	return core, nil
+}
 
+// SockoptFor 全局 sockopt 叠加所有匹配该节点备注的 nodeSockopts
+func (app *XrayApp) SockoptFor(v *V2Ray) common.SockoptConfig {
+	so := app.config.Sockopt
+	for _, n := range app.config.NodeSockopts {
+		matched, err := regexp.MatchString(n.Node, v.Ps)
+		if err != nil || !matched {
+			continue
+		}
+		so = so.Merge(n.Sockopt)
+	}
+	return so
 }
 
-func (app *XrayApp) V2rayToOutboundProxy(v *V2Ray) error {
-	outboundProxy, err := v.TransferToOutbound("proxy_")
-	if err != nil {
-		return err
+func toSockopt(c common.SockoptConfig) *Sockopt {
+	if c.IsZero() {
+		return nil
 	}
-	m := map[string]interface{}{
-		"outbounds": []OutboundObject{outboundProxy},
+	so := &Sockopt{
+		Interface:      c.Interface,
+		DomainStrategy: c.DomainStrategy,
 	}
-	dataProxy, err := json.MarshalIndent(m, "", "    ")
-	if err != nil {
-		log.Errorf("UpdateOutbound json Marshal failed, error: %v", err)
-		return err
+	if c.Mark != 0 {
+		mark := c.Mark
+		so.Mark = &mark
 	}
-	filePathProxy := filepath.Join(app.config.XrayConfigDir, PrefixProxy+outboundProxy.Tag+"_tail.json")
-	err = writeToFile(string(dataProxy), filePathProxy)
-	if err != nil {
-		log.Errorf("UpdateOutbound write to file failed, error: %v", err)
-		return err
+	if c.TCPFastOpen {
+		tfo := true
+		so.TCPFastOpen = &tfo
 	}
-	return nil
+	if c.TCPKeepAliveInterval != 0 {
+		interval := c.TCPKeepAliveInterval
+		so.TCPKeepAliveInterval = &interval
+	}
+	return so
+}
 
+// ProxyOutbound 节点写入 proxy-balancer 的出站
+func (app *XrayApp) ProxyOutbound(v *V2Ray) (OutboundObject, error) {
+	prefix := "proxy_"
+	if v.UDP {
+		prefix = "proxy_udp_"
+	}
+	return app.TransferToOutbound(v, prefix)
 }
 
-func (app *XrayApp) V2rayToOutboundTest(v *V2Ray) error {
-	outboundTest, err := v.TransferToOutbound("test_")
+func (app *XrayApp) V2rayToOutboundProxy(v *V2Ray) error {
+	outboundProxy, err := app.ProxyOutbound(v)
 	if err != nil {
 		return err
 	}
-	m := map[string]interface{}{
-		"outbounds": []OutboundObject{outboundTest},
-	}
-	dataTest, err := json.MarshalIndent(m, "", "    ")
+	return app.writeProxyOutbound(outboundProxy)
+}
+
+func (app *XrayApp) writeProxyOutbound(outbound OutboundObject) error {
+	dataProxy, err := proxyOutboundData(outbound)
 	if err != nil {
 		log.Errorf("UpdateOutbound json Marshal failed, error: %v", err)
 		return err
 	}
-	filePath := filepath.Join(app.config.XrayConfigDir, PrefixTest+outboundTest.Tag+"_tail.json")
-	err = writeToFile(string(dataTest), filePath)
+	filePathProxy := filepath.Join(app.config.XrayConfigDir, PrefixProxy+outbound.Tag+proxyFileSuffix)
+	err = writeToFile(string(dataProxy), filePathProxy)
 	if err != nil {
 		log.Errorf("UpdateOutbound write to file failed, error: %v", err)
 		return err
 	}
 	return nil
-
 }
 
-// UpdateRoutingRule 更新路由规则
-func (app *XrayApp) UpdateRoutingRule(v2rays []*V2Ray) error {
-	fileName := "006route.json"
-	filePath := filepath.Join(app.config.XrayConfigDir, fileName)
-	content := readFromFile(filePath)
-	if content == "" {
-		err := app.InitRouteConfig()
-		if err != nil {
-			return err
-		}
-		content = readFromFile(filePath)
+// proxyOutboundData proxy 出站配置文件的内容
+func proxyOutboundData(outbound OutboundObject) ([]byte, error) {
+	m := map[string]interface{}{
+		"outbounds": []OutboundObject{outbound},
 	}
-	var result map[string]interface{}
+	return json.MarshalIndent(m, "", "    ")
+}
 
-	err := json.Unmarshal([]byte(content), &result)
+// writeProxyOutbounds 删除旧的 proxy 出站文件，每个出站写入一个文件
+func (app *XrayApp) writeProxyOutbounds(outbounds []OutboundObject) error {
+	err := app.RemoveFiles(PrefixProxy)
 	if err != nil {
 		return err
 	}
-	rules := result["routing"].(map[string]interface{})["rules"].([]interface{})
-
-	var finalRules []map[string]interface{}
-	for _, rule := range rules {
-
-		rule1 := rule.(map[string]interface{})
-		tag, ok := rule1["outboundTag"]
-		if !ok || !strings.HasPrefix(tag.(string), "test_") {
-			finalRules = append(finalRules, rule1)
+	for _, o := range outbounds {
+		err := app.writeProxyOutbound(o)
+		if err != nil {
+			return err
 		}
 	}
-
-	templateText := `
-{
-    "type": "field",
-    "domain": [],
-    "ip": [],
-    "network": "tcp",
-    "source": [],
-    "user": [],
-    "inboundTag": ["inbounds-test"],
-    "protocol": [],
-    "attrs": {
-        ":method": "GET",
-        "source": "{{.Source}}"
-    },
-    "outboundTag": "{{.Tag}}"
+	return nil
 }
-`
-	t, err := template.New("rule update").Parse(templateText)
+
+// UpdateProxyOutbounds 用 selected 替换 proxy-balancer 的出站，命名负载均衡从 candidates 中重新选择：
+// 重写配置文件，并通过 api 更新正在运行的 xray，api 更新失败时重启 xray；出站没有变化时什么都不做
+func (app *XrayApp) UpdateProxyOutbounds(selected []*V2Ray, candidates []*V2Ray) error {
+	app.applyMu.Lock()
+	defer app.applyMu.Unlock()
+	outbounds, written := app.proxyOutbounds(selected, candidates)
+	err := app.saveSelected(written, candidates)
 	if err != nil {
-		return err
+		log.Errorf("save selected nodes failed %v", err)
 	}
-	for _, v := range v2rays {
-		var buf bytes.Buffer
-		tag := v.GetTag("test_")
-		encodeTag := url.QueryEscape(tag)
-		m := map[string]string{
-			"Source": encodeTag,
-			"Tag":    tag,
-		}
-		err := t.Execute(&buf, m)
-		if err != nil {
-			log.Errorf("UpdateRoutingRule template execute failed,rule id: %v,error: %v", tag, err)
-			continue
-		}
-		var r map[string]interface{}
-		err = json.Unmarshal(buf.Bytes(), &r)
-		if err != nil {
-			log.Errorf("UpdateRoutingRule json unmarshal failed,rule id: %v,error: %v", tag, err)
-			continue
-		}
-		finalRules = append(finalRules, r)
+	if app.outboundsUnchanged(outbounds) {
+		app.Selected = written
+		app.candidates = candidates
+		log.Infof("proxy outbounds unchanged, %v nodes", len(written))
+		return nil
 	}
-
-	result["routing"].(map[string]interface{})["rules"] = finalRules
-
-	marshal, err := json.MarshalIndent(result, "", "    ")
+	err = app.writeProxyOutbounds(outbounds)
 	if err != nil {
 		return err
 	}
-	err = writeToFile(string(marshal), filePath)
+	app.Selected = written
+	app.candidates = candidates
+
+	err = app.ApplyOutbounds(context.Background(), outbounds)
 	if err != nil {
-		return err
+		log.Errorf("apply outbounds through api failed, restarting: %v", err)
+		return app.Restart(false)
 	}
+	log.Infof("proxy outbounds updated through api, %v nodes, %v outbounds", len(written), len(outbounds))
 	return nil
-
 }
+
 func (app *XrayApp) Kill() {
 	locked := app.killMu.TryLock()
 	if !locked {
@@ -878,20 +992,6 @@ func (app *XrayApp) Kill() {
 		}
 	}
 }
-func (app *XrayApp) TimeTest() {
-	go func() {
-		ticker := time.NewTicker(2 * time.Hour)
-		for range ticker.C {
-			log.Info("TimedTest executing...")
-			err := app.TestAll()
-			if err != nil {
-				return
-			}
-			app.Restart(false)
-		}
-	}()
-}
-
 func (app *XrayApp) Restart(withInit bool) error {
 
 	log.Infof("restarting...")
@@ -908,7 +1008,9 @@ func (app *XrayApp) Restart(withInit bool) error {
 		if err != nil {
 			return err
 		}
-		app.config = config.XrayConfig
+		app.updateConfig(func(c *common.XrayConfig) {
+			*c = config.XrayConfig
+		})
 		err = app.DoStart()
 		if err != nil {
 			return err
@@ -917,10 +1019,6 @@ func (app *XrayApp) Restart(withInit bool) error {
 		if err != nil {
 			return err
 		}
-		err = app.Restart(false)
-		if err != nil {
-			return err
-		}
 
 		return nil
 	}